@@ -0,0 +1,899 @@
+package kwic
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Module 4: Alphabetizer
+
+type alphabetizer struct {
+	storage LineHolder
+	perm    []int // perm[line-1] is the line of storage presented as line
+
+	inverseOnce sync.Once
+	inverse     []int // inverse[perm[i]-1] == i+1, built when first needed
+}
+
+// PermutedHolder is implemented by the LineHolders returned by the
+// alphabetizer constructors, which present the lines of another LineHolder in
+// a different order. Like the rest of the package, it numbers lines from 1.
+type PermutedHolder interface {
+	LineHolder
+	// OriginalIndex returns the number of the line of the other LineHolder
+	// that is presented as sortedLine.
+	OriginalIndex(sortedLine int) int
+	// SortedIndex returns the number of the line presenting originalLine of
+	// the other LineHolder, or 0 if it isn't presented at all.
+	SortedIndex(originalLine int) int
+}
+
+// NewAlphabetizer presents the lines of lines in alphabetical order, as defined
+// by LinesLess. Equal lines keep their relative order from lines. Lines whose
+// keywords aren't their first words, such as those of
+// NewReverseCircularShifter, are ordered as if they began with their keywords,
+// so that they're listed by keyword all the same.
+func NewAlphabetizer(lines LineHolder) LineHolder {
+	return NewAlphabetizerFunc(lines, LinesLess)
+}
+
+// NewAlphabetizerDesc is like NewAlphabetizer but presents the lines in
+// descending order. Equal lines still keep their relative order.
+func NewAlphabetizerDesc(lines LineHolder) LineHolder {
+	return NewAlphabetizerFunc(lines, Descending(LinesLess))
+}
+
+// Descending returns an ordering that reverses less, for use with
+// NewAlphabetizerFunc. Lines that are equal under less remain equal.
+func Descending(less func(lines LineHolder, line1, line2 int) bool) func(lines LineHolder, line1, line2 int) bool {
+	return func(lines LineHolder, line1, line2 int) bool {
+		return less(lines, line2, line1)
+	}
+}
+
+// parallelSortMin is the fewest lines that NewAlphabetizerFunc sorts
+// concurrently. Below it, starting goroutines and merging costs more than it
+// saves.
+const parallelSortMin = 1 << 14
+
+// NewAlphabetizerFunc is like NewAlphabetizer but orders lines by less instead of
+// LinesLess. Lines are sorted with sort.Stable, which keeps equal lines in order
+// without less having to break ties and takes O(n log n) comparisons whatever
+// the input's order. Large inputs are sorted in chunks on as many goroutines as
+// GOMAXPROCS allows, and the chunks are then merged, so less must be safe to
+// call concurrently, as it is if it only reads lines. Like NewAlphabetizer, it
+// gives less each line as if it began with its keyword.
+func NewAlphabetizerFunc(lines LineHolder, less func(lines LineHolder, line1, line2 int) bool) LineHolder {
+	view := keywordFirst(lines)
+	sorter := NewLineSorter(view, less)
+	perm := sorter.Perm
+	sorted := &alphabetizer{storage: lines, perm: perm}
+	workers := runtime.GOMAXPROCS(0)
+	if workers <= 1 || len(perm) < parallelSortMin {
+		sort.Stable(sorter)
+		return sorted
+	}
+	// Sort a chunk of perm on each worker, then merge pairs of adjacent chunks
+	// concurrently until one chunk remains. Merging prefers the earlier chunk
+	// when lines are equal, so the result is still stable.
+	bounds := make([]int, workers+1)
+	for i := range bounds {
+		bounds[i] = i * len(perm) / workers
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(left, right int) {
+			defer wg.Done()
+			sort.Stable(&LineSorter{view, perm[left:right], less})
+		}(bounds[i], bounds[i+1])
+	}
+	wg.Wait()
+	lineLess := func(line1, line2 int) bool {
+		return less(view, line1, line2)
+	}
+	buffer := make([]int, len(perm))
+	for len(bounds) > 2 {
+		merged := []int{0}
+		for i := 0; i+1 < len(bounds); i += 2 {
+			if i+2 == len(bounds) {
+				// An odd chunk out waits for the next round.
+				merged = append(merged, bounds[i+1])
+				continue
+			}
+			wg.Add(1)
+			go func(left, mid, right int) {
+				defer wg.Done()
+				mergeRuns(perm[left:right], buffer[left:right], mid-left, lineLess)
+			}(bounds[i], bounds[i+1], bounds[i+2])
+			merged = append(merged, bounds[i+2])
+		}
+		wg.Wait()
+		bounds = merged
+	}
+	return sorted
+}
+
+// keywordHolder presents each line of another LineHolder rotated to begin with
+// its keyword, so that orderings that look at the beginnings of lines look at
+// their keywords.
+type keywordHolder struct {
+	storage LineHolder
+}
+
+// keywordFirst returns lines with each line rotated to begin with its keyword,
+// or lines itself if every keyword is already first.
+func keywordFirst(lines LineHolder) LineHolder {
+	if _, ok := lines.(KeywordHolder); !ok {
+		return lines
+	}
+	for line := 1; line <= lines.Lines(); line++ {
+		if lines.Words(line) > 0 && KeywordOf(lines, line) != 1 {
+			return &keywordHolder{lines}
+		}
+	}
+	return lines
+}
+
+// storageWord returns which word of the line beneath is the given word of a
+// line.
+func (keyworded *keywordHolder) storageWord(line, word int) int {
+	return (word+KeywordOf(keyworded.storage, line)-2)%keyworded.storage.Words(line) + 1
+}
+
+func (keyworded *keywordHolder) Char(line, word, char int) rune {
+	return keyworded.storage.Char(line, keyworded.storageWord(line, word), char)
+}
+
+func (keyworded *keywordHolder) Lines() int {
+	return keyworded.storage.Lines()
+}
+
+func (keyworded *keywordHolder) Words(line int) int {
+	return keyworded.storage.Words(line)
+}
+
+func (keyworded *keywordHolder) Chars(line, word int) int {
+	return keyworded.storage.Chars(line, keyworded.storageWord(line, word))
+}
+
+// stableLess orders the lines of lines by less, breaking ties by position in
+// lines so that sorting by it is stable.
+func stableLess(lines LineHolder, less func(lines LineHolder, line1, line2 int) bool) func(line1, line2 int) bool {
+	return func(line1, line2 int) bool {
+		if less(lines, line1, line2) {
+			return true
+		}
+		if less(lines, line2, line1) {
+			return false
+		}
+		return line1 < line2
+	}
+}
+
+// NewAlphabetizerTop presents the first n lines that NewAlphabetizerFunc would,
+// or all of them if there are fewer. It keeps only n lines in order as it
+// goes, which takes much less time than sorting all the lines when n is small.
+func NewAlphabetizerTop(lines LineHolder, less func(lines LineHolder, line1, line2 int) bool, n int) LineHolder {
+	lineLess := stableLess(keywordFirst(lines), less)
+	// top is a heap of the first lines seen so far, with the last at the root.
+	top := []int{}
+	for line := 1; line <= lines.Lines() && n > 0; line++ {
+		if len(top) < n {
+			top = append(top, line)
+			for child := len(top) - 1; child > 0; {
+				parent := (child - 1) / 2
+				if !lineLess(top[parent], top[child]) {
+					break
+				}
+				top[parent], top[child] = top[child], top[parent]
+				child = parent
+			}
+		} else if lineLess(line, top[0]) {
+			top[0] = line
+			siftDown(top, 0, len(top), lineLess)
+		}
+	}
+	heapSort(top, lineLess)
+	return &alphabetizer{storage: lines, perm: top}
+}
+
+// LineSorter adapts lines to sort.Interface, so that they can be sorted by the
+// sort package, as NewAlphabetizerFunc sorts them with sort.Stable. Sorting
+// it reorders Perm, which lists lines of Lines, and Holder presents the lines in
+// that order.
+type LineSorter struct {
+	Lines LineHolder
+	Perm  []int
+	Order func(lines LineHolder, line1, line2 int) bool
+}
+
+// NewLineSorter returns a LineSorter listing every line of lines in order, to be
+// sorted by less.
+func NewLineSorter(lines LineHolder, less func(lines LineHolder, line1, line2 int) bool) *LineSorter {
+	perm := make([]int, lines.Lines())
+	for i := range perm {
+		perm[i] = i + 1
+	}
+	return &LineSorter{lines, perm, less}
+}
+
+func (sorter *LineSorter) Len() int {
+	return len(sorter.Perm)
+}
+
+func (sorter *LineSorter) Less(i, j int) bool {
+	return sorter.Order(sorter.Lines, sorter.Perm[i], sorter.Perm[j])
+}
+
+func (sorter *LineSorter) Swap(i, j int) {
+	sorter.Perm[i], sorter.Perm[j] = sorter.Perm[j], sorter.Perm[i]
+}
+
+// Holder presents the lines of sorter.Lines in the order of sorter.Perm, as the
+// alphabetizers do. sorter.Perm must not change afterward.
+func (sorter *LineSorter) Holder() LineHolder {
+	return &alphabetizer{storage: sorter.Lines, perm: sorter.Perm}
+}
+
+// mergeRuns merges the sorted runs perm[:mid] and perm[mid:] by less, using
+// buffer, which must be as long as perm, as scratch space. Lines that are equal
+// under less come from perm[:mid] first.
+func mergeRuns(perm, buffer []int, mid int, less func(line1, line2 int) bool) {
+	i, j := 0, mid
+	for k := range buffer {
+		if j == len(perm) || i < mid && !less(perm[j], perm[i]) {
+			buffer[k] = perm[i]
+			i++
+		} else {
+			buffer[k] = perm[j]
+			j++
+		}
+	}
+	copy(perm, buffer)
+}
+
+// heapSort sorts perm in place by less in O(n log n) time.
+func heapSort(perm []int, less func(line1, line2 int) bool) {
+	for root := len(perm)/2 - 1; root >= 0; root-- {
+		siftDown(perm, root, len(perm), less)
+	}
+	for end := len(perm) - 1; end > 0; end-- {
+		perm[0], perm[end] = perm[end], perm[0]
+		siftDown(perm, 0, end, less)
+	}
+}
+
+// siftDown restores the order of the heap perm[:end], in which each line sorts
+// after its children, after the line at root has been replaced.
+func siftDown(perm []int, root, end int, less func(line1, line2 int) bool) {
+	for {
+		child := 2*root + 1
+		if child >= end {
+			return
+		}
+		if child+1 < end && less(perm[child], perm[child+1]) {
+			child++
+		}
+		if !less(perm[root], perm[child]) {
+			return
+		}
+		perm[root], perm[child] = perm[child], perm[root]
+		root = child
+	}
+}
+
+func (alpha *alphabetizer) OriginalIndex(sortedLine int) int {
+	return alpha.perm[sortedLine-1]
+}
+
+func (alpha *alphabetizer) SortedIndex(originalLine int) int {
+	alpha.inverseOnce.Do(func() {
+		alpha.inverse = make([]int, alpha.storage.Lines())
+		for i, line := range alpha.perm {
+			alpha.inverse[line-1] = i + 1
+		}
+	})
+	return alpha.inverse[originalLine-1]
+}
+
+func (alpha *alphabetizer) Char(line, word, char int) rune {
+	return alpha.storage.Char(alpha.perm[line-1], word, char)
+}
+
+func (alpha *alphabetizer) OriginalLine(line int) int {
+	return OriginalLineOf(alpha.storage, alpha.perm[line-1])
+}
+
+func (alpha *alphabetizer) StartWord(line int) int {
+	return StartWordOf(alpha.storage, alpha.perm[line-1])
+}
+
+func (alpha *alphabetizer) Keyword(line int) int {
+	return KeywordOf(alpha.storage, alpha.perm[line-1])
+}
+
+func (alpha *alphabetizer) Lines() int {
+	return len(alpha.perm)
+}
+
+func (alpha *alphabetizer) Words(line int) int {
+	return alpha.storage.Words(alpha.perm[line-1])
+}
+
+func (alpha *alphabetizer) Chars(line, word int) int {
+	return alpha.storage.Chars(alpha.perm[line-1], word)
+}
+
+// latinBases gives the unaccented lowercase letter that each character from
+// U+00C0 through U+017F is a form of, or '-' for characters that aren't. Letters
+// that aren't simply accented, such as "ß" and "ø", are placed with the letters
+// they're usually alphabetized with.
+const latinBases = "" +
+	"aaaaaaaceeeeiiiidnooooo-ouuuuy-s" + // U+00C0
+	"aaaaaaaceeeeiiiidnooooo-ouuuuy-y" + // U+00E0
+	"aaaaaaccccccccddddeeeeeeeeeegggg" + // U+0100
+	"gggghhhhiiiiiiiiiiiijjkkklllllll" + // U+0120
+	"lllnnnnnnnnnoooooooorrrrrrssssss" + // U+0140
+	"ssttttttuuuuuuuuuuuuwwyyyzzzzzzs" //   U+0160
+
+// baseLetter returns the unaccented lowercase Latin letter that char is a form
+// of, or 0 if it isn't one.
+func baseLetter(char rune) rune {
+	switch {
+	case char >= 'a' && char <= 'z':
+		return char
+	case char >= 'A' && char <= 'Z':
+		return char - 'A' + 'a'
+	case char >= 0xc0 && char < 0xc0+rune(len(latinBases)) && latinBases[char-0xc0] != '-':
+		return rune(latinBases[char-0xc0])
+	}
+	return 0
+}
+
+// NormalizeChar returns the rank of a character in the collating order, where
+// every character has a distinct rank. First come all characters that are
+// neither letters nor digits, in code point order. Then come the letters. Each
+// Latin letter is followed by its lowercase form and then by its accented forms,
+// each uppercase form just before its lowercase form ("A" < "a" < "À" < "à" <
+// "B" < ... < "z"). Letters of other scripts follow "z", grouped in the same
+// way by their lowercase forms. Last come the digits, in code point order.
+func NormalizeChar(char rune) uint64 {
+	// The rank packs (from most to least significant) a primary weight for
+	// the letter or class, the lowercase accented form, whether the character
+	// is lowercase, and the character itself to break any remaining ties.
+	var primary, accent, lower uint64
+	if base := baseLetter(char); base != 0 {
+		primary = 1 + uint64(base-'a')
+		if char >= 0x80 {
+			accent = uint64(unicode.ToLower(char))
+		}
+	} else if unicode.IsLetter(char) {
+		primary = 1 + 26 + uint64(unicode.ToLower(char))
+	} else if unicode.IsDigit(char) {
+		primary = 1 << 21
+	}
+	if unicode.IsLower(char) {
+		lower = 1
+	}
+	return primary<<31 | accent<<22 | lower<<21 | uint64(char)
+}
+
+// WordsLess reports whether the first word sorts before the second.
+func WordsLess(lines LineHolder, line1, word1, line2, word2 int) bool {
+	chars1 := lines.Chars(line1, word1)
+	chars2 := lines.Chars(line2, word2)
+	char := 1
+	for {
+		if char > chars1 && char <= chars2 {
+			return true
+		}
+		if char > chars2 {
+			return false
+		}
+		n1 := NormalizeChar(lines.Char(line1, word1, char))
+		n2 := NormalizeChar(lines.Char(line2, word2, char))
+		if n1 < n2 {
+			return true
+		} else if n1 > n2 {
+			return false
+		}
+		char++
+	}
+}
+
+// LinesLess reports whether the first line sorts before the second, comparing
+// word by word.
+func LinesLess(lines LineHolder, line1, line2 int) bool {
+	words1 := lines.Words(line1)
+	words2 := lines.Words(line2)
+	word := 1
+	for {
+		if word > words1 && word <= words2 {
+			return true
+		}
+		if word > words2 {
+			return false
+		}
+		if WordsLess(lines, line1, word, line2, word) {
+			return true
+		}
+		if WordsLess(lines, line2, word, line1, word) {
+			return false
+		}
+		word++
+	}
+}
+
+// WordsEqual reports whether two words sort as equal, that is, whether neither
+// is WordsLess than the other.
+func WordsEqual(lines LineHolder, line1, word1, line2, word2 int) bool {
+	chars := lines.Chars(line1, word1)
+	if chars != lines.Chars(line2, word2) {
+		return false
+	}
+	for char := 1; char <= chars; char++ {
+		n1 := NormalizeChar(lines.Char(line1, word1, char))
+		n2 := NormalizeChar(lines.Char(line2, word2, char))
+		if n1 != n2 {
+			return false
+		}
+	}
+	return true
+}
+
+// LinesEqual reports whether two lines sort as equal, that is, whether neither
+// is LinesLess than the other.
+func LinesEqual(lines LineHolder, line1, line2 int) bool {
+	words := lines.Words(line1)
+	if words != lines.Words(line2) {
+		return false
+	}
+	for word := 1; word <= words; word++ {
+		if !WordsEqual(lines, line1, word, line2, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// Collator defines an order on the lines of a LineHolder for
+// NewCollatedAlphabetizer.
+type Collator interface {
+	// Less reports whether the first line sorts before the second.
+	Less(lines LineHolder, line1, line2 int) bool
+}
+
+// CollatorFunc adapts an ordering function such as LinesLess to a Collator.
+type CollatorFunc func(lines LineHolder, line1, line2 int) bool
+
+func (less CollatorFunc) Less(lines LineHolder, line1, line2 int) bool {
+	return less(lines, line1, line2)
+}
+
+var (
+	// DefaultCollator orders lines by LinesLess, as NewAlphabetizer does.
+	DefaultCollator Collator = CollatorFunc(LinesLess)
+	// NumericCollator orders lines by NumericLinesLess.
+	NumericCollator Collator = CollatorFunc(NumericLinesLess)
+	// CodePointCollator orders lines by CodePointLinesLess.
+	CodePointCollator Collator = CollatorFunc(CodePointLinesLess)
+)
+
+// NewCollatedAlphabetizer is like NewAlphabetizer but orders lines by collator,
+// or by DefaultCollator if collator is nil.
+func NewCollatedAlphabetizer(lines LineHolder, collator Collator) LineHolder {
+	if collator == nil {
+		collator = DefaultCollator
+	}
+	return NewAlphabetizerFunc(lines, collator.Less)
+}
+
+// CaseCollator orders lines like LinesLess but ignoring differences in case.
+// It breaks ties between lines that differ only in case at the first character
+// that differs, putting uppercase first, or lowercase first if LowerFirst.
+type CaseCollator struct {
+	LowerFirst bool
+}
+
+func (collator CaseCollator) Less(lines LineHolder, line1, line2 int) bool {
+	tie := 0 // the order of the first characters that differ only in case
+	words1 := lines.Words(line1)
+	words2 := lines.Words(line2)
+	for word := 1; word <= words1 && word <= words2; word++ {
+		chars1 := lines.Chars(line1, word)
+		chars2 := lines.Chars(line2, word)
+		for char := 1; char <= chars1 && char <= chars2; char++ {
+			n1 := NormalizeChar(lines.Char(line1, word, char))
+			n2 := NormalizeChar(lines.Char(line2, word, char))
+			folded1 := NormalizeChar(unicode.ToLower(lines.Char(line1, word, char)))
+			folded2 := NormalizeChar(unicode.ToLower(lines.Char(line2, word, char)))
+			if folded1 != folded2 {
+				return folded1 < folded2
+			}
+			// NormalizeChar ranks uppercase letters before their
+			// lowercase forms.
+			if tie == 0 && n1 < n2 {
+				tie = -1
+			} else if tie == 0 && n1 > n2 {
+				tie = 1
+			}
+		}
+		if chars1 != chars2 {
+			return chars1 < chars2
+		}
+	}
+	if words1 != words2 {
+		return words1 < words2
+	}
+	if collator.LowerFirst {
+		return tie > 0
+	}
+	return tie < 0
+}
+
+// StringCollator orders lines by comparing their words in turn with Compare,
+// which returns a negative number, zero, or a positive number as its first
+// argument sorts before, with, or after its second. It's a way to use the rules
+// of a particular language, such as those of golang.org/x/text/collate:
+//
+//	kwic.StringCollator{Compare: collate.New(language.Swedish).CompareString}
+type StringCollator struct {
+	Compare func(a, b string) int
+}
+
+func (collator StringCollator) Less(lines LineHolder, line1, line2 int) bool {
+	words1 := lines.Words(line1)
+	words2 := lines.Words(line2)
+	for word := 1; word <= words1 && word <= words2; word++ {
+		order := collator.Compare(
+			string(WordBytes(lines, line1, word)),
+			string(WordBytes(lines, line2, word)))
+		if order != 0 {
+			return order < 0
+		}
+	}
+	return words1 < words2
+}
+
+// languageLetters gives the letters that each language alphabetizes as letters
+// of their own rather than as accented forms of Latin letters, in lowercase.
+// Each list gives the letter they follow and then the letters, in order. Letters
+// joined by "=" are forms of one letter, the first being the language's own,
+// and are ordered among themselves just as accented letters are.
+// Languages that alphabetize accented letters with their unaccented forms, as
+// NormalizeChar does, have no letters to list.
+var languageLetters = map[string][]string{
+	"da": {"z", "æ=ä", "ø=ö", "å"},
+	"de": nil,
+	"en": nil,
+	"es": {"n", "ñ"},
+	"fi": {"z", "å", "ä=æ", "ö=ø"},
+	"nb": {"z", "æ=ä", "ø=ö", "å"},
+	"nn": {"z", "æ=ä", "ø=ö", "å"},
+	"no": {"z", "æ=ä", "ø=ö", "å"},
+	"sv": {"z", "å", "ä=æ", "ö=ø"},
+}
+
+// LanguageCollator returns a Collator that orders lines like LinesLess but with
+// the letters of a language in its own alphabetical order, such as "å", "ä",
+// and "ö" after "z" in Swedish. tag is a BCP 47 language tag such as "sv" or
+// "sv-SE", of which only the language is used. It returns an error for a
+// language it has no rules for.
+func LanguageCollator(tag string) (Collator, error) {
+	language := strings.ToLower(tag)
+	if i := strings.IndexAny(language, "-_"); i >= 0 {
+		language = language[:i]
+	}
+	letters, ok := languageLetters[language]
+	if !ok {
+		return nil, fmt.Errorf("no collation rules for language %q", tag)
+	}
+	if len(letters) == 0 {
+		return DefaultCollator, nil
+	}
+	// Each letter is ranked after every form of the letter it follows by
+	// giving it that letter's primary weight and an accent weight greater
+	// than any accented character's.
+	primary := NormalizeChar([]rune(letters[0])[0]) &^ (1<<31 - 1)
+	accent := uint64(languageAccents)
+	ranks := map[rune]uint64{}
+	for _, place := range letters[1:] {
+		for _, letter := range strings.Split(place, "=") {
+			ranks[[]rune(letter)[0]] = primary | accent<<22
+			accent++
+		}
+	}
+	return languageCollator{ranks}, nil
+}
+
+// languageAccents is one more than the greatest accent weight NormalizeChar
+// gives.
+const languageAccents = 0xc0 + len(latinBases)
+
+type languageCollator struct {
+	ranks map[rune]uint64 // the ranks of the lowercase letters given their own places, without their case
+}
+
+// rank is like NormalizeChar but places the collator's letters.
+func (collator languageCollator) rank(char rune) uint64 {
+	if rank, ok := collator.ranks[unicode.ToLower(char)]; ok {
+		rank |= uint64(char)
+		if unicode.IsLower(char) {
+			rank |= 1 << 21
+		}
+		return rank
+	}
+	return NormalizeChar(char)
+}
+
+func (collator languageCollator) Less(lines LineHolder, line1, line2 int) bool {
+	words1 := lines.Words(line1)
+	words2 := lines.Words(line2)
+	for word := 1; word <= words1 && word <= words2; word++ {
+		chars1 := lines.Chars(line1, word)
+		chars2 := lines.Chars(line2, word)
+		for char := 1; char <= chars1 && char <= chars2; char++ {
+			n1 := collator.rank(lines.Char(line1, word, char))
+			n2 := collator.rank(lines.Char(line2, word, char))
+			if n1 != n2 {
+				return n1 < n2
+			}
+		}
+		if chars1 != chars2 {
+			return chars1 < chars2
+		}
+	}
+	return words1 < words2
+}
+
+// CodePointLinesLess is like LinesLess but compares characters by their Unicode
+// code points alone, so "Zebra" sorts before "apple", as in the C locale.
+func CodePointLinesLess(lines LineHolder, line1, line2 int) bool {
+	words1 := lines.Words(line1)
+	words2 := lines.Words(line2)
+	for word := 1; word <= words1 && word <= words2; word++ {
+		chars1 := lines.Chars(line1, word)
+		chars2 := lines.Chars(line2, word)
+		for char := 1; char <= chars1 && char <= chars2; char++ {
+			c1 := lines.Char(line1, word, char)
+			c2 := lines.Char(line2, word, char)
+			if c1 != c2 {
+				return c1 < c2
+			}
+		}
+		if chars1 != chars2 {
+			return chars1 < chars2
+		}
+	}
+	return words1 < words2
+}
+
+// KeywordLess reports whether the keyword of the first line sorts before that of
+// the second, comparing code points as CodePointLinesLess does. The rest of the
+// lines is ignored, as GNU ptx ignores it.
+func KeywordLess(lines LineHolder, line1, line2 int) bool {
+	keyword1 := KeywordOf(lines, line1)
+	keyword2 := KeywordOf(lines, line2)
+	chars1 := lines.Chars(line1, keyword1)
+	chars2 := lines.Chars(line2, keyword2)
+	for char := 1; char <= chars1 && char <= chars2; char++ {
+		c1 := lines.Char(line1, keyword1, char)
+		c2 := lines.Char(line2, keyword2, char)
+		if c1 != c2 {
+			return c1 < c2
+		}
+	}
+	return chars1 < chars2
+}
+
+// NumericLinesLess is like LinesLess, except that runs of the digits "0"
+// through "9" compare by their numeric values, so "file2" sorts before
+// "file10". Runs differing only in leading zeros compare as equal.
+func NumericLinesLess(lines LineHolder, line1, line2 int) bool {
+	words1 := lines.Words(line1)
+	words2 := lines.Words(line2)
+	for word := 1; word <= words1 && word <= words2; word++ {
+		order := numericWordsCompare(lines, line1, word, line2, word)
+		if order != 0 {
+			return order < 0
+		}
+	}
+	return words1 < words2
+}
+
+// numericWordsCompare returns -1, 0, or 1 as the first word sorts before, equal
+// to, or after the second, as described for NumericLinesLess.
+func numericWordsCompare(lines LineHolder, line1, word1, line2, word2 int) int {
+	chars1 := lines.Chars(line1, word1)
+	chars2 := lines.Chars(line2, word2)
+	isDigit := func(char rune) bool {
+		return char >= '0' && char <= '9'
+	}
+	// digits returns the digits of the run starting at char, without leading
+	// zeros, and the character after the run.
+	digits := func(line, word, char, chars int) ([]rune, int) {
+		run := []rune{}
+		for ; char <= chars && isDigit(lines.Char(line, word, char)); char++ {
+			if len(run) > 0 || lines.Char(line, word, char) != '0' {
+				run = append(run, lines.Char(line, word, char))
+			}
+		}
+		return run, char
+	}
+	char1, char2 := 1, 1
+	for char1 <= chars1 && char2 <= chars2 {
+		c1 := lines.Char(line1, word1, char1)
+		c2 := lines.Char(line2, word2, char2)
+		if isDigit(c1) && isDigit(c2) {
+			var run1, run2 []rune
+			run1, char1 = digits(line1, word1, char1, chars1)
+			run2, char2 = digits(line2, word2, char2, chars2)
+			if len(run1) != len(run2) {
+				if len(run1) < len(run2) {
+					return -1
+				}
+				return 1
+			}
+			for i := range run1 {
+				if run1[i] != run2[i] {
+					if run1[i] < run2[i] {
+						return -1
+					}
+					return 1
+				}
+			}
+			continue
+		}
+		n1, n2 := NormalizeChar(c1), NormalizeChar(c2)
+		if n1 != n2 {
+			if n1 < n2 {
+				return -1
+			}
+			return 1
+		}
+		char1++
+		char2++
+	}
+	switch {
+	case char1 > chars1 && char2 <= chars2:
+		return -1
+	case char2 > chars2 && char1 <= chars1:
+		return 1
+	}
+	return 0
+}
+
+// wordMatches reports whether a word equals query, in the sense of WordsEqual.
+func wordMatches(lines LineHolder, line, word int, query []rune) bool {
+	if lines.Chars(line, word) != len(query) {
+		return false
+	}
+	for char := 1; char <= len(query); char++ {
+		if NormalizeChar(lines.Char(line, word, char)) != NormalizeChar(query[char-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContainsFilter keeps the lines of lines having a word that matches query.
+func NewContainsFilter(lines LineHolder, query []rune) LineHolder {
+	return NewLineFilter(lines, func(line int) bool {
+		for word := 1; word <= lines.Words(line); word++ {
+			if wordMatches(lines, line, word, query) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// NewKeywordFilter keeps the lines of lines whose keyword matches keyword. Lines
+// without any words have no keyword, so they're dropped.
+func NewKeywordFilter(lines LineHolder, keyword []rune) LineHolder {
+	return NewLineFilter(lines, func(line int) bool {
+		return lines.Words(line) > 0 &&
+			wordMatches(lines, line, KeywordOf(lines, line), keyword)
+	})
+}
+
+// Entry is a line of an index as Lookup finds it.
+type Entry struct {
+	Line       int    `json:"line"`                 // the number of the line in the index
+	Text       string `json:"text"`                 // the line as RenderLine renders it
+	SourceLine int    `json:"sourceLine,omitempty"` // the input line it came from, or 0 if that isn't known
+}
+
+// Lookup returns the lines of lines whose keywords begin with prefix, which must
+// be sorted by LinesLess, as by NewAlphabetizer. Characters are compared by
+// NormalizeChar. Since such lines are next to each other, Lookup finds the first
+// by binary search.
+func Lookup(lines LineHolder, prefix string) []Entry {
+	query := []rune(prefix)
+	// compare returns the order of the beginning of the keyword of line
+	// relative to query, or 0 if the keyword begins with query.
+	compare := func(line int) int {
+		if lines.Words(line) == 0 {
+			if len(query) == 0 {
+				return 0
+			}
+			return -1
+		}
+		keyword := KeywordOf(lines, line)
+		chars := lines.Chars(line, keyword)
+		for char := 1; char <= len(query); char++ {
+			if char > chars {
+				return -1
+			}
+			n1 := NormalizeChar(lines.Char(line, keyword, char))
+			n2 := NormalizeChar(query[char-1])
+			if n1 != n2 {
+				if n1 < n2 {
+					return -1
+				}
+				return 1
+			}
+		}
+		return 0
+	}
+	entries := []Entry{}
+	first := 1 + sort.Search(lines.Lines(), func(i int) bool {
+		return compare(i+1) >= 0
+	})
+	for line := first; line <= lines.Lines() && compare(line) == 0; line++ {
+		entries = append(entries, Entry{line, RenderLine(lines, line), OriginalLineOf(lines, line)})
+	}
+	return entries
+}
+
+// Soundex returns the American Soundex code of a UTF-8 word, such as "S530" for
+// both "Smith" and "Smyth", or "" if the word has no Latin letters. Accented
+// letters are coded as their unaccented forms.
+func Soundex(word []byte) string {
+	const codes = "01230120022455012623010202" // for 'a' through 'z'
+	code := []byte{}
+	last := byte(0)
+	for _, char := range string(word) {
+		char = baseLetter(char)
+		if char == 0 {
+			continue
+		}
+		digit := codes[char-'a']
+		if len(code) == 0 {
+			code = append(code, byte(char-'a'+'A'))
+		} else if digit != '0' && digit != last && len(code) < 4 {
+			code = append(code, digit)
+		}
+		// 'h' and 'w' don't separate consonants with the same code.
+		if char != 'h' && char != 'w' {
+			last = digit
+		}
+	}
+	for len(code) > 0 && len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// SoundexLess orders lines by the Soundex code of their first words, falling
+// back to LinesLess for lines with equal codes. This groups keywords that sound
+// alike. Lines without words have the empty code, as words without Latin
+// letters do.
+func SoundexLess(lines LineHolder, line1, line2 int) bool {
+	code := func(line int) string {
+		if lines.Words(line) == 0 {
+			return ""
+		}
+		return Soundex(WordBytes(lines, line, 1))
+	}
+	code1, code2 := code(line1), code(line2)
+	if code1 != code2 {
+		return code1 < code2
+	}
+	return LinesLess(lines, line1, line2)
+}
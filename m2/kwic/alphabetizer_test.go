@@ -0,0 +1,425 @@
+package kwic
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// numberedLines returns storage holding n one-word lines "w0000000", "w0000001",
+// and so on, which are in alphabetical order, or in reverse if descending.
+func numberedLines(n int, descending bool) *LineStorage {
+	storage := &LineStorage{}
+	for i := 0; i < n; i++ {
+		if descending {
+			storage.AppendLine([]byte(fmt.Sprintf("w%07d", n-1-i)))
+		} else {
+			storage.AppendLine([]byte(fmt.Sprintf("w%07d", i)))
+		}
+	}
+	return storage
+}
+
+// checkSorted reports an error unless sorted presents every line of lines once,
+// in the order of less.
+func checkSorted(t *testing.T, lines, sorted LineHolder, less func(lines LineHolder, line1, line2 int) bool) {
+	t.Helper()
+	if sorted.Lines() != lines.Lines() {
+		t.Fatalf("sorted %d lines into %d", lines.Lines(), sorted.Lines())
+	}
+	seen := make([]bool, lines.Lines())
+	permuted := sorted.(PermutedHolder)
+	for line := 1; line <= sorted.Lines(); line++ {
+		original := permuted.OriginalIndex(line)
+		if seen[original-1] {
+			t.Fatalf("line %d is presented twice", original)
+		}
+		seen[original-1] = true
+		if line > 1 && less(sorted, line, line-1) {
+			t.Fatalf("line %d (%q) sorts after line %d (%q)",
+				line-1, RenderLine(sorted, line-1), line, RenderLine(sorted, line))
+		}
+	}
+}
+
+func TestAlphabetizerPresortedInput(t *testing.T) {
+	for _, descending := range []bool{false, true} {
+		for _, n := range []int{0, 1, 2, 3, 100, 5000} {
+			lines := numberedLines(n, descending)
+			checkSorted(t, lines, NewAlphabetizer(lines), LinesLess)
+		}
+	}
+}
+
+// duplicateLines returns storage holding n one-word lines with only distinct
+// different words among them, in no particular order.
+func duplicateLines(n, distinct int) *LineStorage {
+	storage := &LineStorage{}
+	for i := 0; i < n; i++ {
+		storage.AppendLine([]byte(fmt.Sprintf("w%d", i*7919%distinct)))
+	}
+	return storage
+}
+
+func TestAlphabetizerDuplicates(t *testing.T) {
+	for _, n := range []int{10, 1000, 50000} {
+		lines := duplicateLines(n, 7)
+		sorted := NewAlphabetizer(lines)
+		checkSorted(t, lines, sorted, LinesLess)
+		// Equal lines must keep their order from the input.
+		permuted := sorted.(PermutedHolder)
+		for line := 2; line <= sorted.Lines(); line++ {
+			if LinesEqual(sorted, line-1, line) && permuted.OriginalIndex(line-1) > permuted.OriginalIndex(line) {
+				t.Fatalf("n=%d: equal lines %d and %d are out of input order",
+					n, permuted.OriginalIndex(line-1), permuted.OriginalIndex(line))
+			}
+		}
+	}
+}
+
+func BenchmarkAlphabetizerSorted(b *testing.B) {
+	lines := numberedLines(200000, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewAlphabetizer(lines)
+	}
+}
+
+func BenchmarkAlphabetizerReverseSorted(b *testing.B) {
+	lines := numberedLines(200000, true)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewAlphabetizer(lines)
+	}
+}
+
+func BenchmarkAlphabetizerDuplicates(b *testing.B) {
+	lines := duplicateLines(200000, 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewAlphabetizer(lines)
+	}
+}
+
+func TestSoundex(t *testing.T) {
+	tests := []struct {
+		word, code string
+	}{
+		{"Robert", "R163"},
+		{"Rupert", "R163"},
+		{"Smith", "S530"},
+		{"Smyth", "S530"},
+		{"Ashcraft", "A261"},
+		{"Tymczak", "T522"},
+		{"Pfister", "P236"},
+		{"Lee", "L000"},
+		{"Müller", "M460"},
+		{"42", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if code := Soundex([]byte(test.word)); code != test.code {
+			t.Errorf("Soundex(%q) = %q, want %q", test.word, code, test.code)
+		}
+	}
+}
+
+func TestSoundexLess(t *testing.T) {
+	storage := &LineStorage{array: [][][]rune{
+		{[]rune("Smyth"), []rune("b")},
+		{},
+		{[]rune("Robert")},
+		{[]rune("Jones")},
+		{[]rune("Smith"), []rune("a")},
+		{[]rune("Johns")},
+	}}
+	sorted := NewAlphabetizerFunc(storage, SoundexLess)
+	want := []string{"", "Johns", "Jones", "Robert", "Smith a", "Smyth b"}
+	for line := 1; line <= sorted.Lines(); line++ {
+		if got := RenderLine(sorted, line); got != want[line-1] {
+			t.Errorf("line %d is %q, want %q", line, got, want[line-1])
+		}
+	}
+}
+
+func TestLanguageCollator(t *testing.T) {
+	tests := []struct {
+		tag   string
+		words []string // in order
+	}{
+		{"en", []string{"abc", "äpple", "åsna", "ödla", "zebra"}},
+		{"sv", []string{"abc", "zebra", "åsna", "Äpple", "äpple", "ödla"}},
+		{"sv-SE", []string{"Zebra", "Åsna", "äpple", "æble", "öl", "øl"}},
+		{"da", []string{"zebra", "æble", "äpple", "øl", "ödla", "åsna"}},
+		{"es", []string{"nube", "número", "Ñu", "ñu", "oso"}},
+	}
+	for _, test := range tests {
+		collator, err := LanguageCollator(test.tag)
+		if err != nil {
+			t.Errorf("LanguageCollator(%q): %v", test.tag, err)
+			continue
+		}
+		storage := &LineStorage{}
+		for i := len(test.words) - 1; i >= 0; i-- {
+			storage.AppendLine([]byte(test.words[i]))
+		}
+		sorted := NewCollatedAlphabetizer(storage, collator)
+		for line := 1; line <= sorted.Lines(); line++ {
+			if got := RenderLine(sorted, line); got != test.words[line-1] {
+				t.Errorf("%s: line %d is %q, want %q", test.tag, line, got, test.words[line-1])
+			}
+		}
+	}
+	if _, err := LanguageCollator("tlh"); err == nil {
+		t.Errorf("LanguageCollator(%q) succeeded, want an error", "tlh")
+	}
+}
+
+func TestContainsFilter(t *testing.T) {
+	const text = "The cat sat\nno match here\ncat\nconcatenate Cat\n"
+	tests := []struct {
+		query string
+		fold  bool
+		want  []string
+	}{
+		{"cat", false, []string{"cat", "cat sat The", "sat The cat", "The cat sat"}},
+		{"Cat", false, []string{"Cat concatenate", "concatenate Cat"}},
+		{"CAT", true, []string{"cat", "cat concatenate", "cat sat the", "concatenate cat", "sat the cat", "the cat sat"}},
+		{"ca", false, nil},
+		{"", false, nil},
+	}
+	for _, test := range tests {
+		opts := InputOptions{Fold: test.fold}
+		storage := &LineStorage{}
+		if err := InputFrom(strings.NewReader(text), storage, opts); err != nil {
+			t.Fatal(err)
+		}
+		query := []rune(test.query)
+		for i := range query {
+			query[i] = opts.StoredChar(query[i])
+		}
+		filtered := NewContainsFilter(NewAlphabetizer(NewCircularShifter(storage)), query)
+		got := []string{}
+		for line := 1; line <= filtered.Lines(); line++ {
+			got = append(got, RenderLine(filtered, line))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q (fold %v): kept %q, want %q", test.query, test.fold, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeCharClasses(t *testing.T) {
+	// Punctuation, then letters, then digits, each character with its own rank.
+	order := []rune{' ', '\'', '-', '.', 'A', 'a', 'z', '0', '1', '2', '9'}
+	for i := 1; i < len(order); i++ {
+		if NormalizeChar(order[i-1]) >= NormalizeChar(order[i]) {
+			t.Errorf("%q ranks %d, not below %q at %d",
+				order[i-1], NormalizeChar(order[i-1]), order[i], NormalizeChar(order[i]))
+		}
+	}
+	inputs := []string{
+		"word2\nword10\nword-a\nworda\n",
+		"worda\nword-a\nword10\nword2\n",
+		"word10\nworda\nword2\nword-a\n",
+	}
+	for _, text := range inputs {
+		if got, want := indexText(t, text), "word-a\nworda\nword10\nword2\n"; got != want {
+			t.Errorf("%q indexed as %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestComparisonTrichotomy(t *testing.T) {
+	lines := StorageFromLines([][]string{
+		{"apple"}, {"Apple"}, {"APPLE"}, {"apple"}, {"apples"}, {"app"},
+		{"apple", "pie"}, {"apple", "Pie"}, {"café"}, {"cafe"}, {"a-b"}, {"ab"}, {"a1"},
+	})
+	for line1 := 1; line1 <= lines.Lines(); line1++ {
+		for line2 := 1; line2 <= lines.Lines(); line2++ {
+			name := fmt.Sprintf("%q and %q", RenderLine(lines, line1), RenderLine(lines, line2))
+			less, equal, greater := WordsLess(lines, line1, 1, line2, 1),
+				WordsEqual(lines, line1, 1, line2, 1), WordsLess(lines, line2, 1, line1, 1)
+			if count(less, equal, greater) != 1 {
+				t.Errorf("first words of %s: less %v, equal %v, greater %v", name, less, equal, greater)
+			}
+			if equal != (string(WordBytes(lines, line1, 1)) == string(WordBytes(lines, line2, 1))) {
+				t.Errorf("first words of %s: equal %v", name, equal)
+			}
+			less, equal, greater = LinesLess(lines, line1, line2),
+				LinesEqual(lines, line1, line2), LinesLess(lines, line2, line1)
+			if count(less, equal, greater) != 1 {
+				t.Errorf("%s: less %v, equal %v, greater %v", name, less, equal, greater)
+			}
+			if equal != (RenderLine(lines, line1) == RenderLine(lines, line2)) {
+				t.Errorf("%s: equal %v", name, equal)
+			}
+		}
+	}
+}
+
+// count returns how many of conditions are true.
+func count(conditions ...bool) int {
+	n := 0
+	for _, condition := range conditions {
+		if condition {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAlphabetizerStable(t *testing.T) {
+	lines := StorageFromLines([][]string{
+		{"pear"}, {"apple"}, {"Apple"}, {"pear"}, {"apple"}, {"APPLE"}, {"fig"}, {"apple"}, {"pear"},
+	})
+	folded := StringCollator{Compare: func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	}}
+	tests := []struct {
+		name   string
+		sorted LineHolder
+		want   []int // the lines of lines in the order presented
+	}{
+		{"ascending", NewAlphabetizer(lines), []int{6, 3, 2, 5, 8, 7, 1, 4, 9}},
+		{"descending", NewAlphabetizerDesc(lines), []int{1, 4, 9, 7, 2, 5, 8, 3, 6}},
+		{"top", NewAlphabetizerTop(lines, LinesLess, 4), []int{6, 3, 2, 5}},
+		{"folded", NewCollatedAlphabetizer(lines, folded), []int{2, 3, 5, 6, 8, 7, 1, 4, 9}},
+	}
+	for _, test := range tests {
+		permuted := test.sorted.(PermutedHolder)
+		got := []int{}
+		for line := 1; line <= test.sorted.Lines(); line++ {
+			got = append(got, permuted.OriginalIndex(line))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: presented lines %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// withProcs calls f with GOMAXPROCS set to procs, restoring it afterward.
+func withProcs(procs int, f func()) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+	f()
+}
+
+func TestAlphabetizerParallel(t *testing.T) {
+	// Enough shifts to reach parallelSortMin, with many equal lines.
+	storage := corpus(parallelSortMin/4 + 100)
+	orders := []struct {
+		name string
+		sort func() LineHolder
+	}{
+		{"ascending", func() LineHolder { return NewAlphabetizer(NewCircularShifter(storage)) }},
+		{"descending", func() LineHolder { return NewAlphabetizerDesc(NewCircularShifter(storage)) }},
+		{"reversed", func() LineHolder { return NewAlphabetizer(NewReverseCircularShifter(storage)) }},
+	}
+	for _, order := range orders {
+		var serial LineHolder
+		withProcs(1, func() { serial = order.sort() })
+		if serial.Lines() < parallelSortMin {
+			t.Fatalf("only %d lines, fewer than parallelSortMin", serial.Lines())
+		}
+		for _, procs := range []int{2, 3, 8} {
+			var parallel LineHolder
+			withProcs(procs, func() { parallel = order.sort() })
+			want, got := serial.(*alphabetizer).perm, parallel.(*alphabetizer).perm
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s with GOMAXPROCS %d: order differs from serial sort", order.name, procs)
+			}
+		}
+	}
+}
+
+func benchmarkAlphabetizerProcs(b *testing.B, procs int) {
+	shifts := NewCircularShifter(corpus(50000))
+	withProcs(procs, func() {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			NewAlphabetizer(shifts)
+		}
+	})
+}
+
+func BenchmarkAlphabetizerSerial(b *testing.B) {
+	benchmarkAlphabetizerProcs(b, 1)
+}
+
+func BenchmarkAlphabetizerParallel(b *testing.B) {
+	// At least two, so that the parallel path is taken even on one CPU.
+	procs := runtime.NumCPU()
+	if procs < 2 {
+		procs = 2
+	}
+	benchmarkAlphabetizerProcs(b, procs)
+}
+
+func TestCaseCollator(t *testing.T) {
+	lines := StorageFromLines([][]string{
+		{"apple"}, {"banana"}, {"APPLE"}, {"Apple"}, {"aPple"}, {"Apples"}, {"apple", "Pie"}, {"apple", "pie"},
+	})
+	tests := []struct {
+		collator Collator
+		want     string
+	}{
+		{CaseCollator{}, "APPLE Apple aPple apple apple Pie apple pie Apples banana"},
+		{CaseCollator{LowerFirst: true}, "apple aPple Apple APPLE apple pie apple Pie Apples banana"},
+	}
+	for _, test := range tests {
+		sorted := NewCollatedAlphabetizer(lines, test.collator)
+		checkSorted(t, lines, sorted, test.collator.Less)
+		got := []string{}
+		for line := 1; line <= sorted.Lines(); line++ {
+			got = append(got, RenderLine(sorted, line))
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("LowerFirst %v: sorted %q, want %q", test.collator.(CaseCollator).LowerFirst, strings.Join(got, " "), test.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	text := "apple pie\nApple cart\nzebra crossing\napricot\nbanana split\n"
+	index := NewAlphabetizer(NewCircularShifter(storageOf(t, text)))
+	folded := &LineStorage{}
+	if err := InputFrom(strings.NewReader(text), folded, InputOptions{Fold: true}); err != nil {
+		t.Fatal(err)
+	}
+	// foldQuery folds a prefix as -fold does for -interactive.
+	foldQuery := func(prefix string) string {
+		query := []rune(prefix)
+		for i := range query {
+			query[i] = InputOptions{Fold: true}.StoredChar(query[i])
+		}
+		return string(query)
+	}
+	tests := []struct {
+		name   string
+		index  LineHolder
+		prefix string
+		want   []Entry
+	}{
+		{"empty prefix", NewAlphabetizer(NewCircularShifter(storageOf(t, "b\na\n"))), "",
+			[]Entry{{1, "a", 2}, {2, "b", 1}}},
+		{"no match", index, "q", []Entry{}},
+		{"past the end", index, "zz", []Entry{}},
+		{"before the start", index, "0", []Entry{}},
+		{"first", index, "Apple", []Entry{{1, "Apple cart", 2}}},
+		{"last", index, "zeb", []Entry{{9, "zebra crossing", 3}}},
+		{"several", index, "ap", []Entry{{2, "apple pie", 1}, {3, "apricot", 4}}},
+		{"whole keyword", index, "apricot", []Entry{{3, "apricot", 4}}},
+		{"longer than keyword", index, "apricots", []Entry{}},
+		{"case differs", index, "APP", []Entry{}},
+		{"folded", NewAlphabetizer(NewCircularShifter(folded)), foldQuery("APP"),
+			[]Entry{{1, "apple cart", 2}, {2, "apple pie", 1}}},
+		{"reversed", NewAlphabetizer(NewReverseCircularShifter(storageOf(t, text))), "c",
+			[]Entry{{5, "Apple cart", 2}, {6, "zebra crossing", 3}}},
+	}
+	for _, test := range tests {
+		if got := Lookup(test.index, test.prefix); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: Lookup(%q) = %v, want %v", test.name, test.prefix, got, test.want)
+		}
+	}
+}
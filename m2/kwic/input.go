@@ -0,0 +1,324 @@
+package kwic
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Module 2: Input
+
+// InputOptions controls how input functions store words.
+type InputOptions struct {
+	Fold         bool   // store letters in lowercase
+	BareCR       bool   // end lines at carriage returns not followed by newlines
+	Separators   string // characters that separate words, or "" for just spaces
+	SplitHyphens bool   // also separate words at hyphens, as in "mother-in-law"
+	SplitSlashes bool   // also separate words at slashes, as in "and/or"
+	TrimPunct    bool   // drop punctuation from the ends of words in text input
+	// MaxBinary, if positive, is the largest fraction of the characters at the
+	// beginning of text input that may be other than text before InputFrom
+	// gives up on it. Any NUL gives up on it too.
+	MaxBinary float64
+}
+
+// isSeparator reports whether char separates words.
+func (opts InputOptions) isSeparator(char rune) bool {
+	switch {
+	case opts.SplitHyphens && char == '-', opts.SplitSlashes && char == '/':
+		return true
+	case opts.Separators == "":
+		return char == ' '
+	}
+	return char != '\n' && strings.ContainsRune(opts.Separators, char)
+}
+
+// StoredChar returns the character to store for an input character.
+func (opts InputOptions) StoredChar(char rune) rune {
+	if opts.Fold {
+		return unicode.ToLower(char)
+	}
+	return char
+}
+
+// Input reads the named file into storage as InputFrom does.
+func Input(filename string, storage LineBuilder, opts InputOptions) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return InputFrom(file, storage, opts)
+}
+
+// InputFrom reads UTF-8 text from r into storage, after any lines it already
+// holds. Words are separated by spaces (or opts.Separators) and lines by
+// newlines, including Windows-style line endings of a carriage return and a
+// newline. Lines without words aren't stored, but storage numbers the lines
+// that are by their places in the input, continuing from any lines it already
+// holds, as if all its input were one file. Each byte that isn't part of valid
+// UTF-8 is read as U+FFFD, the Unicode replacement character. Input compressed
+// with gzip is decompressed first.
+func InputFrom(r io.Reader, storage LineBuilder, opts InputOptions) error {
+	reader, err := decompress(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	if opts.MaxBinary > 0 {
+		err = checkText(reader, opts.MaxBinary)
+		if err != nil {
+			return err
+		}
+	}
+	line, word, char := storage.Lines()+1, 1, 1
+	// With opts.TrimPunct, punctuation after the start of a word waits here
+	// until it turns out not to end the word.
+	pending := []rune{}
+	for {
+		value, _, err := reader.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if value == '\r' {
+			next, err := reader.Peek(1)
+			if err == nil && next[0] == '\n' {
+				// The newline that follows ends the line.
+				continue
+			}
+			if opts.BareCR {
+				value = '\n'
+			}
+		}
+		if opts.isSeparator(value) {
+			// Skip runs of separators rather than creating empty words.
+			if char > 1 {
+				word++
+				char = 1
+			}
+			pending = pending[:0]
+		} else if value == '\n' {
+			// Skip blank lines, which have no words to store, but count
+			// them so that later lines keep their numbers.
+			if word > 1 || char > 1 {
+				line++
+			} else {
+				storage.SkipLines(1)
+			}
+			word, char = 1, 1
+			pending = pending[:0]
+		} else if opts.TrimPunct && unicode.IsPunct(value) {
+			// Drop leading punctuation right away.
+			if char > 1 {
+				pending = append(pending, opts.StoredChar(value))
+			}
+		} else {
+			for _, value := range append(pending, opts.StoredChar(value)) {
+				err = storage.SetWord(line, word, char, value)
+				if err != nil {
+					return err
+				}
+				char++
+			}
+			pending = pending[:0]
+		}
+	}
+	return nil
+}
+
+// InputPrefixed reads the named file in the length-prefixed format written by
+// OutputPrefixed, where each word is its length in characters in decimal, a
+// colon, and its characters, as in "5:hello". Words are stored verbatim aside
+// from opts, so they may contain spaces and newlines. Outside of words, spaces
+// are ignored and newlines end lines.
+func InputPrefixed(filename string, storage LineBuilder, opts InputOptions) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return InputPrefixedFrom(file, storage, opts)
+}
+
+// InputPrefixedFrom is like InputPrefixed but reads from r. Like InputFrom, it
+// adds lines after any that storage already holds and decompresses gzip input.
+func InputPrefixedFrom(r io.Reader, storage LineBuilder, opts InputOptions) error {
+	reader, err := decompress(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	line, word := storage.Lines()+1, 1
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case b == ' ':
+		case b == '\n':
+			if word > 1 {
+				line++
+				word = 1
+			} else {
+				storage.SkipLines(1)
+			}
+		case b >= '0' && b <= '9':
+			length := int(b - '0')
+			for {
+				b, err = reader.ReadByte()
+				if err == io.EOF {
+					return io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					return err
+				}
+				if b == ':' {
+					break
+				}
+				if b < '0' || b > '9' {
+					return fmt.Errorf("unexpected %q in word length", b)
+				}
+				length = length*10 + int(b-'0')
+			}
+			for char := 1; char <= length; char++ {
+				value, _, err := reader.ReadRune()
+				if err == io.EOF {
+					return io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					return err
+				}
+				err = storage.SetWord(line, word, char, opts.StoredChar(value))
+				if err != nil {
+					return err
+				}
+			}
+			if length > 0 {
+				word++
+			}
+		default:
+			return fmt.Errorf("unexpected %q outside of a word", b)
+		}
+	}
+}
+
+// binarySniffLen is how many bytes checkText looks at.
+const binarySniffLen = 1024
+
+// checkText returns an error if the first bytes of reader contain a NUL or a
+// greater fraction than max of characters that aren't text: control characters
+// other than whitespace and invalid UTF-8. It doesn't consume anything.
+func checkText(reader *bufio.Reader, max float64) error {
+	sample, err := reader.Peek(binarySniffLen)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	chars, binary := 0, 0
+	for len(sample) > 0 && utf8.FullRune(sample) {
+		char, size := utf8.DecodeRune(sample)
+		switch {
+		case char == 0:
+			return fmt.Errorf("input looks binary: it contains a NUL byte")
+		case char == utf8.RuneError && size == 1,
+			unicode.IsControl(char) && !unicode.IsSpace(char):
+			binary++
+		}
+		chars++
+		sample = sample[size:]
+	}
+	if float64(binary) > max*float64(chars) {
+		return fmt.Errorf("input looks binary: %d of its first %d characters aren't text", binary, chars)
+	}
+	return nil
+}
+
+// decompress returns a reader of the decompressed contents of reader if they
+// begin like a gzip stream, or reader itself otherwise.
+func decompress(reader *bufio.Reader) (*bufio.Reader, error) {
+	magic, err := reader.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		// Any error will come up again on the next read.
+		return reader, nil
+	}
+	unzipped, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(unzipped), nil
+}
+
+// ReadNoiseWords reads a set of noise words for NewCircularShifterWithNoise
+// from r, which lists them separated by spaces or newlines. It reads the words
+// of ShiftOptions.Only just as well.
+func ReadNoiseWords(r io.Reader) (map[string]bool, error) {
+	noise := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		noise[scanner.Text()] = true
+	}
+	return noise, scanner.Err()
+}
+
+// lineFilter presents only those lines of another LineHolder that satisfy a
+// predicate, in their original order.
+type lineFilter struct {
+	storage LineHolder
+	kept    []int
+}
+
+// NewLineFilter presents the lines of storage for which keep returns true.
+func NewLineFilter(storage LineHolder, keep func(line int) bool) LineHolder {
+	filter := &lineFilter{storage: storage}
+	for line := 1; line <= storage.Lines(); line++ {
+		if keep(line) {
+			filter.kept = append(filter.kept, line)
+		}
+	}
+	return filter
+}
+
+// NewMaxWordsFilter drops the lines of storage with more than max words.
+func NewMaxWordsFilter(storage LineHolder, max int) LineHolder {
+	return NewLineFilter(storage, func(line int) bool {
+		return storage.Words(line) <= max
+	})
+}
+
+func (filter *lineFilter) Char(line, word, char int) rune {
+	return filter.storage.Char(filter.kept[line-1], word, char)
+}
+
+func (filter *lineFilter) Lines() int {
+	return len(filter.kept)
+}
+
+func (filter *lineFilter) Words(line int) int {
+	return filter.storage.Words(filter.kept[line-1])
+}
+
+func (filter *lineFilter) Chars(line, word int) int {
+	return filter.storage.Chars(filter.kept[line-1], word)
+}
+
+func (filter *lineFilter) OriginalLine(line int) int {
+	return inputLineOf(filter.storage, filter.kept[line-1])
+}
+
+func (filter *lineFilter) StartWord(line int) int {
+	return StartWordOf(filter.storage, filter.kept[line-1])
+}
+
+func (filter *lineFilter) Keyword(line int) int {
+	return KeywordOf(filter.storage, filter.kept[line-1])
+}
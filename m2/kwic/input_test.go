@@ -0,0 +1,359 @@
+package kwic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInputBinary(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxBinary float64
+		wantErr   string // a substring of the error, or "" for none
+	}{
+		{"text", "hello world\n", 0.1, ""},
+		{"NUL", "hello\x00world\n", 0.1, "NUL"},
+		{"NUL unchecked", "hello\x00world\n", 0, ""},
+		{"NUL allowing all", "hello\x00world\n", 1, "NUL"},
+		{"controls", "\x01\x02\x03 abc\n", 0.1, "3 of its first 8 characters"},
+		{"few controls", "\x01 abcdefghijklmnopqrstuvwxyz\n", 0.1, ""},
+		{"invalid UTF-8", "\xff\xfe\xfd\n", 0.5, "aren't text"},
+		{"tabs", "a\tb\r\nc\n", 0.01, ""},
+		{"empty", "", 0.1, ""},
+	}
+	for _, test := range tests {
+		storage := &LineStorage{}
+		err := InputFrom(strings.NewReader(test.text), storage, InputOptions{MaxBinary: test.maxBinary})
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.wantErr != "" && err == nil:
+			t.Errorf("%s: stored %d lines, want an error containing %q", test.name, storage.Lines(), test.wantErr)
+		case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+			t.Errorf("%s: error %q, want one containing %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestInputPrefixed(t *testing.T) {
+	words := [][]string{
+		{"a b", "line\nbreak", "plain"},
+		{"10:colon", "élan"},
+		{"\r\n"},
+	}
+	storage := StorageFromLines(words)
+	var encoded strings.Builder
+	if _, err := OutputPrefixed(&encoded, storage); err != nil {
+		t.Fatal(err)
+	}
+	if want := "3:a b 10:line\nbreak 5:plain\n8:10:colon 4:élan\n2:\r\n\n"; encoded.String() != want {
+		t.Errorf("OutputPrefixed wrote %q, want %q", encoded.String(), want)
+	}
+	decoded := &LineStorage{}
+	if err := InputPrefixedFrom(strings.NewReader(encoded.String()), decoded, InputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Lines() != len(words) {
+		t.Fatalf("decoded %d lines, want %d", decoded.Lines(), len(words))
+	}
+	for line := 1; line <= decoded.Lines(); line++ {
+		if decoded.Words(line) != len(words[line-1]) {
+			t.Errorf("line %d has %d words, want %d", line, decoded.Words(line), len(words[line-1]))
+			continue
+		}
+		for word := 1; word <= decoded.Words(line); word++ {
+			if got := string(WordBytes(decoded, line, word)); got != words[line-1][word-1] {
+				t.Errorf("word %d of line %d is %q, want %q", word, line, got, words[line-1][word-1])
+			}
+		}
+	}
+	for _, bad := range []string{"5:abc", "3a:abc", "abc\n", "2"} {
+		if err := InputPrefixedFrom(strings.NewReader(bad), &LineStorage{}, InputOptions{}); err == nil {
+			t.Errorf("InputPrefixedFrom(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestMaxWordsFilter(t *testing.T) {
+	storage := storageOf(t, "one two three four five six\none\n\none two three four five\n")
+	tests := []struct {
+		max  int
+		want []int // the input lines kept
+	}{
+		{5, []int{2, 4}},
+		{6, []int{1, 2, 4}},
+		{1, []int{2}},
+		{0, nil},
+	}
+	for _, test := range tests {
+		filtered := NewMaxWordsFilter(storage, test.max)
+		got := []int{}
+		for line := 1; line <= filtered.Lines(); line++ {
+			if filtered.Words(line) > test.max {
+				t.Errorf("max %d: kept line %d with %d words", test.max, line, filtered.Words(line))
+			}
+			got = append(got, OriginalLineOf(filtered, line))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("max %d: kept input lines %v, want %v", test.max, got, test.want)
+		}
+	}
+}
+
+func TestInputFold(t *testing.T) {
+	tests := []struct {
+		text string
+		want string // the index of the stored lines
+	}{
+		{"The CAT sat\n", "cat sat the\nsat the cat\nthe cat sat\n"},
+		{"Apple\napple\nAPPLE\n", "apple\napple\napple\n"},
+		{"ÉCLAIR Ünder\n", "éclair ünder\nünder éclair\n"},
+	}
+	for _, test := range tests {
+		storage := &LineStorage{}
+		if err := InputFrom(strings.NewReader(test.text), storage, InputOptions{Fold: true}); err != nil {
+			t.Fatal(err)
+		}
+		for line := 1; line <= storage.Lines(); line++ {
+			if text := RenderLine(storage, line); text != strings.ToLower(text) {
+				t.Errorf("%q: stored %q", test.text, text)
+			}
+		}
+		var out strings.Builder
+		if _, err := Output(&out, NewAlphabetizer(NewCircularShifter(storage))); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%q: index is %q, want %q", test.text, out.String(), test.want)
+		}
+	}
+}
+
+func TestInputSpaces(t *testing.T) {
+	tests := []struct {
+		text  string
+		words [][]string
+	}{
+		{"  a  b  \n", [][]string{{"a", "b"}}},
+		{"a  b\n \nc\n", [][]string{{"a", "b"}, {"c"}}},
+		{"    \n", nil},
+		{" ", nil},
+	}
+	for _, test := range tests {
+		storage := storageOf(t, test.text)
+		var got [][]string
+		for line := 1; line <= storage.Lines(); line++ {
+			var words []string
+			for word := 1; word <= storage.Words(line); word++ {
+				words = append(words, string(WordBytes(storage, line, word)))
+			}
+			got = append(got, words)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.words) {
+			t.Errorf("%q: stored %q, want %q", test.text, got, test.words)
+		}
+	}
+	if got, want := indexText(t, "  a  b  \n   \n"), "a b\nb a\n"; got != want {
+		t.Errorf("indexed %q, want %q", got, want)
+	}
+}
+
+func TestInputBlankLines(t *testing.T) {
+	if got, want := indexText(t, "a\n\nb\n"), "a\nb\n"; got != want {
+		t.Errorf("indexed %q, want %q", got, want)
+	}
+	storage := storageOf(t, "\n\na\n\n\nb\n\n")
+	if storage.Lines() != 2 {
+		t.Fatalf("stored %d lines, want 2", storage.Lines())
+	}
+	// The lines keep their numbers in the input.
+	for line, want := range []int{3, 6} {
+		if got := storage.OriginalLine(line + 1); got != want {
+			t.Errorf("line %d came from line %d, want %d", line+1, got, want)
+		}
+	}
+}
+
+func TestInputCarriageReturns(t *testing.T) {
+	tests := []struct {
+		text   string
+		bareCR bool
+		words  [][]string
+	}{
+		{"foo\r\nbar\r\n", false, [][]string{{"foo"}, {"bar"}}},
+		{"foo bar\r\n\r\nbaz\r\n", false, [][]string{{"foo", "bar"}, {"baz"}}},
+		{"foo\r\nbar", false, [][]string{{"foo"}, {"bar"}}},
+		{"foo\rbar\n", false, [][]string{{"foo\rbar"}}},
+		{"foo\rbar\n", true, [][]string{{"foo"}, {"bar"}}},
+		{"foo\r\r\nbar\r", true, [][]string{{"foo"}, {"bar"}}},
+	}
+	for _, test := range tests {
+		storage := &LineStorage{}
+		if err := InputFrom(strings.NewReader(test.text), storage, InputOptions{BareCR: test.bareCR}); err != nil {
+			t.Fatal(err)
+		}
+		if got := wordsOf(storage); fmt.Sprint(got) != fmt.Sprint(test.words) {
+			t.Errorf("%q, BareCR %v: stored %q, want %q", test.text, test.bareCR, got, test.words)
+		}
+	}
+}
+
+func TestInputSeparators(t *testing.T) {
+	tests := []struct {
+		text       string
+		separators string
+		words      [][]string
+	}{
+		{"a\tb c\n", "", [][]string{{"a\tb", "c"}}},
+		{"a\tb c\n", " \t", [][]string{{"a", "b", "c"}}},
+		{"\t a \t\t b  \tc\t\n", " \t", [][]string{{"a", "b", "c"}}},
+		{" \t \t\n\t\na\n", " \t", [][]string{{"a"}}},
+		{"a,b;;c d\n", ",;", [][]string{{"a", "b", "c d"}}},
+		{"a\nb\n", "\n", [][]string{{"a"}, {"b"}}},
+	}
+	for _, test := range tests {
+		storage := &LineStorage{}
+		if err := InputFrom(strings.NewReader(test.text), storage, InputOptions{Separators: test.separators}); err != nil {
+			t.Fatal(err)
+		}
+		if got := wordsOf(storage); fmt.Sprint(got) != fmt.Sprint(test.words) {
+			t.Errorf("%q split at %q: stored %q, want %q", test.text, test.separators, got, test.words)
+		}
+	}
+}
+
+// byteReader reads one byte per call to Read, as Module 2 once read its file.
+type byteReader struct {
+	r io.Reader
+}
+
+func (reader byteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return reader.r.Read(p[:1])
+}
+
+// benchmarkInputFile times InputFrom on a file of a few megabytes, read
+// through wrap.
+func benchmarkInputFile(b *testing.B, wrap func(r io.Reader) io.Reader) {
+	var text bytes.Buffer
+	for i := 0; text.Len() < 4<<20; i++ {
+		fmt.Fprintf(&text, "word%d the%d Context%d ending\n", i*7%1009, i%13, i*31%4093)
+	}
+	path := filepath.Join(b.TempDir(), "input.txt")
+	if err := os.WriteFile(path, text.Bytes(), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(text.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := InputFrom(wrap(file), &LineStorage{}, InputOptions{}); err != nil {
+			b.Fatal(err)
+		}
+		file.Close()
+	}
+}
+
+func BenchmarkInputFile(b *testing.B) {
+	benchmarkInputFile(b, func(r io.Reader) io.Reader { return r })
+}
+
+// BenchmarkInputFileByByte makes a system call for each byte despite InputFrom's
+// buffering, for comparison with BenchmarkInputFile.
+func BenchmarkInputFileByByte(b *testing.B) {
+	benchmarkInputFile(b, func(r io.Reader) io.Reader { return byteReader{r} })
+}
+
+func TestInputTrimPunct(t *testing.T) {
+	tests := []struct {
+		text  string
+		words [][]string
+	}{
+		{"hello, world!\n", [][]string{{"hello", "world"}}},
+		{"--\n", nil},
+		{"a -- b\n", [][]string{{"a", "b"}}},
+		{"(world) don't \"stop\"...\n", [][]string{{"world", "don't", "stop"}}},
+		{"e.g. 3.14\n", [][]string{{"e.g", "3.14"}}},
+		{"!!! ?\nend.\n", [][]string{{"end"}}},
+	}
+	for _, test := range tests {
+		storage := &LineStorage{}
+		if err := InputFrom(strings.NewReader(test.text), storage, InputOptions{TrimPunct: true}); err != nil {
+			t.Fatal(err)
+		}
+		if got := wordsOf(storage); fmt.Sprint(got) != fmt.Sprint(test.words) {
+			t.Errorf("%q: stored %q, want %q", test.text, got, test.words)
+		}
+	}
+}
+
+// gzipped returns text compressed with gzip.
+func gzipped(t *testing.T, text string) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestInputGzip(t *testing.T) {
+	text := "the quick fox\n\njumped over\r\nthe lazy dog\n"
+	want := wordsOf(storageOf(t, text))
+	path := filepath.Join(t.TempDir(), "input.txt.gz")
+	if err := os.WriteFile(path, gzipped(t, text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	storage := &LineStorage{}
+	if err := Input(path, storage, InputOptions{}); err != nil {
+		t.Fatalf("Input: %v", err)
+	}
+	if got := wordsOf(storage); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+	// The gzip header is recognized whatever the input is called.
+	storage = &LineStorage{}
+	if err := InputFrom(bytes.NewReader(gzipped(t, text)), storage, InputOptions{}); err != nil {
+		t.Fatalf("InputFrom: %v", err)
+	}
+	if got := wordsOf(storage); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+	storage = &LineStorage{}
+	if err := InputPrefixedFrom(bytes.NewReader(gzipped(t, "3:the 5:quick\n")), storage, InputOptions{}); err != nil {
+		t.Fatalf("InputPrefixedFrom: %v", err)
+	}
+	if got := wordsOf(storage); fmt.Sprint(got) != "[[the quick]]" {
+		t.Errorf("stored %q from prefixed input, want [[the quick]]", got)
+	}
+	compressed := gzipped(t, text)
+	corrupt := []struct {
+		name  string
+		input []byte
+	}{
+		{"truncated", compressed[:len(compressed)/2]},
+		{"bad header", append([]byte{0x1f, 0x8b, 0}, compressed[3:]...)},
+		{"bad checksum", append(append([]byte{}, compressed[:len(compressed)-8]...), 0, 0, 0, 0, 0, 0, 0, 0)},
+	}
+	for _, test := range corrupt {
+		if err := InputFrom(bytes.NewReader(test.input), &LineStorage{}, InputOptions{}); err == nil {
+			t.Errorf("%s: no error reading a corrupt gzip stream", test.name)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Package kwic builds KWIC (Key Word in Context) indexes using the second
+// decomposition from David Parnas's 1971 paper "On the criteria to be used in
+// decomposing systems into modules". Each module hides a design decision behind
+// the LineHolder interface: line storage, input, circular shifting,
+// alphabetizing, and output.
+package kwic
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// LineHolder is the interface shared by the line storage and the modules that
+// present transformed views of it. Lines, words, and characters are numbered
+// from 1. Characters are Unicode code points.
+//
+// Once made, the modules in this package only read the lines beneath them, so
+// any number of goroutines may read them at once, as long as nothing changes
+// those lines: no lines are added to or edited in the storage beneath, and
+// nothing is appended to an Indexer. To keep indexing while others read, add
+// lines to a SyncStorage and build the other modules over its snapshots.
+type LineHolder interface {
+	// Char returns the requested character of a word in a line.
+	Char(line, word, char int) rune
+	// Lines returns the total number of lines.
+	Lines() int
+	// Words returns the number of words in a line.
+	Words(line int) int
+	// Chars returns the number of characters in a word.
+	Chars(line, word int) int
+}
+
+// RotatedHolder is implemented by LineHolders whose lines are rotations of the
+// lines of another LineHolder.
+type RotatedHolder interface {
+	LineHolder
+	// StartWord returns which word of the unrotated line begins the line.
+	StartWord(line int) int
+}
+
+// StartWordOf returns which word of the unrotated line begins a line, or 1 if
+// lines doesn't rotate.
+func StartWordOf(lines LineHolder, line int) int {
+	if rotated, ok := lines.(RotatedHolder); ok {
+		return rotated.StartWord(line)
+	}
+	return 1
+}
+
+// OriginalHolder is implemented by LineHolders that know which line of the
+// input each of their lines came from.
+type OriginalHolder interface {
+	LineHolder
+	// OriginalLine returns the number of the input line that a line came
+	// from, or 0 if that isn't known.
+	OriginalLine(line int) int
+}
+
+// OriginalLineOf returns the number of the input line that a line came from, or
+// 0 if lines doesn't know.
+func OriginalLineOf(lines LineHolder, line int) int {
+	if original, ok := lines.(OriginalHolder); ok {
+		return original.OriginalLine(line)
+	}
+	return 0
+}
+
+// inputLineOf is like OriginalLineOf but assumes that lines are input lines
+// unless lines says otherwise. Holders that select or rearrange the lines of
+// storage use it to report original lines.
+func inputLineOf(storage LineHolder, line int) int {
+	if original, ok := storage.(OriginalHolder); ok {
+		return original.OriginalLine(line)
+	}
+	return line
+}
+
+// KeywordHolder is implemented by LineHolders whose keywords aren't always the
+// first words of their lines.
+type KeywordHolder interface {
+	LineHolder
+	// Keyword returns which word of the line is its keyword.
+	Keyword(line int) int
+}
+
+// KeywordOf returns which word of a line is its keyword, which is 1 unless lines
+// says otherwise.
+func KeywordOf(lines LineHolder, line int) int {
+	if keyworded, ok := lines.(KeywordHolder); ok {
+		return keyworded.Keyword(line)
+	}
+	return 1
+}
+
+// WordBytes returns the characters of a word in a line encoded as UTF-8.
+func WordBytes(lines LineHolder, line, word int) []byte {
+	chars := make([]byte, 0, lines.Chars(line, word))
+	for char := 1; char <= lines.Chars(line, word); char++ {
+		chars = utf8.AppendRune(chars, lines.Char(line, word, char))
+	}
+	return chars
+}
+
+// LineChars returns the total number of characters in the words of a line.
+func LineChars(lines LineHolder, line int) int {
+	chars := 0
+	for word := 1; word <= lines.Words(line); word++ {
+		chars += lines.Chars(line, word)
+	}
+	return chars
+}
+
+// concatHolder presents the lines of several LineHolders end to end. ends[i] is
+// the number of lines in holders[0] through holders[i].
+type concatHolder struct {
+	holders []LineHolder
+	ends    []int
+}
+
+// NewConcatHolder presents the lines of each of holders in turn, as if they
+// were one LineHolder.
+func NewConcatHolder(holders ...LineHolder) LineHolder {
+	concat := &concatHolder{holders: holders, ends: make([]int, len(holders))}
+	total := 0
+	for i, holder := range holders {
+		total += holder.Lines()
+		concat.ends[i] = total
+	}
+	return concat
+}
+
+// locate returns the holder containing a line and the line's number there.
+func (concat *concatHolder) locate(line int) (LineHolder, int) {
+	i, line := concat.find(line)
+	return concat.holders[i], line
+}
+
+// find returns the index of the holder containing a line and the line's number
+// there.
+func (concat *concatHolder) find(line int) (int, int) {
+	if line < 1 || line > concat.Lines() {
+		panic(fmt.Sprintf("line %d is out of range: %d holders have %d lines", line, len(concat.holders), concat.Lines()))
+	}
+	// The first holder whose lines end at or after line, which skips any
+	// holders without lines.
+	i := sort.SearchInts(concat.ends, line)
+	if i > 0 {
+		line -= concat.ends[i-1]
+	}
+	return i, line
+}
+
+// checkWord panics if line, which is line local of holder i, has no such word,
+// naming the holder that it overflowed.
+func (concat *concatHolder) checkWord(i, line, local, word int) {
+	if words := concat.holders[i].Words(local); word < 1 || word > words {
+		panic(fmt.Sprintf("word %d of line %d is out of range: it's line %d of holder %d, which has %d words",
+			word, line, local, i+1, words))
+	}
+}
+
+func (concat *concatHolder) Char(line, word, char int) rune {
+	i, local := concat.find(line)
+	concat.checkWord(i, line, local, word)
+	holder := concat.holders[i]
+	if chars := holder.Chars(local, word); char < 1 || char > chars {
+		panic(fmt.Sprintf("character %d of word %d of line %d is out of range: it's line %d of holder %d, whose word has %d characters",
+			char, word, line, local, i+1, chars))
+	}
+	return holder.Char(local, word, char)
+}
+
+func (concat *concatHolder) Lines() int {
+	if len(concat.ends) == 0 {
+		return 0
+	}
+	return concat.ends[len(concat.ends)-1]
+}
+
+func (concat *concatHolder) Words(line int) int {
+	holder, line := concat.locate(line)
+	return holder.Words(line)
+}
+
+func (concat *concatHolder) Chars(line, word int) int {
+	i, local := concat.find(line)
+	concat.checkWord(i, line, local, word)
+	return concat.holders[i].Chars(local, word)
+}
+
+func (concat *concatHolder) OriginalLine(line int) int {
+	holder, line := concat.locate(line)
+	return OriginalLineOf(holder, line)
+}
+
+func (concat *concatHolder) StartWord(line int) int {
+	holder, line := concat.locate(line)
+	return StartWordOf(holder, line)
+}
+
+func (concat *concatHolder) Keyword(line int) int {
+	holder, line := concat.locate(line)
+	return KeywordOf(holder, line)
+}
+
+// Index reads text from r and writes its alphabetized circular shifts to w, one
+// per line. It runs the same pipeline as the kwic command with no options.
+func Index(r io.Reader, w io.Writer) error {
+	storage := &LineStorage{}
+	err := InputFrom(r, storage, InputOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = Output(w, NewAlphabetizer(NewCircularShifter(storage)))
+	return err
+}
+
+// IndexBatched writes the same index of the text of inputs as Index would of
+// their concatenation, but holds at most batch input lines in memory at once.
+// Each batch is indexed and written to a temporary file with OutputPartial, and
+// the files are then combined with MergePartials. Each input is decompressed
+// separately if it's compressed with gzip. Only memory use is bounded: nothing
+// is written to w until every input has been read, since the last line read
+// may begin the index.
+func IndexBatched(w io.Writer, batch int, opts InputOptions, inputs ...io.Reader) (int64, error) {
+	var partials []*os.File
+	defer func() {
+		for _, file := range partials {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	var text bytes.Buffer
+	lines := 0
+	flush := func() error {
+		if lines == 0 {
+			return nil
+		}
+		storage := &LineStorage{}
+		err := InputFrom(&text, storage, opts)
+		text.Reset()
+		lines = 0
+		if err != nil {
+			return err
+		}
+		file, err := os.CreateTemp("", "kwic-batch-")
+		if err != nil {
+			return err
+		}
+		partials = append(partials, file)
+		_, err = OutputPartial(file, NewAlphabetizer(NewCircularShifter(storage)))
+		return err
+	}
+	for _, input := range inputs {
+		reader, err := decompress(bufio.NewReader(input))
+		if err != nil {
+			return 0, err
+		}
+		for err != io.EOF {
+			var line []byte
+			line, err = reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			if len(line) == 0 {
+				continue
+			}
+			text.Write(line)
+			if line[len(line)-1] != '\n' {
+				// Don't run the last line of one input into the next.
+				text.WriteByte('\n')
+			}
+			lines++
+			if lines == batch {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	readers := make([]io.Reader, len(partials))
+	for i, file := range partials {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		readers[i] = file
+	}
+	return MergePartials(w, readers)
+}
+
+// Indexer maintains the alphabetized circular shifts of lines as they're added,
+// without sorting all of them again each time.
+type Indexer struct {
+	opts    InputOptions
+	storage *LineStorage
+	shifter *circularShifter
+	perm    []int
+}
+
+// NewIndexer returns an Indexer with no lines, which reads the lines given to
+// Append as InputFrom does with opts.
+func NewIndexer(opts InputOptions) *Indexer {
+	storage := &LineStorage{}
+	return &Indexer{
+		opts:    opts,
+		storage: storage,
+		shifter: &circularShifter{storage: storage},
+	}
+}
+
+// Append adds the lines of text to the index. Each of their circular shifts is
+// inserted into place by binary search. If reading text fails partway, as for
+// corrupt gzip data, the lines read before the error are still indexed.
+func (indexer *Indexer) Append(text string) error {
+	first := indexer.storage.Lines() + 1
+	err := InputFrom(strings.NewReader(text), indexer.storage, indexer.opts)
+	less := stableLess(indexer.shifter, LinesLess)
+	for line := first; line <= indexer.storage.Lines(); line++ {
+		for word := 1; word <= indexer.storage.Words(line); word++ {
+			indexer.shifter.shifts = append(indexer.shifter.shifts, shift{line, word})
+			added := len(indexer.shifter.shifts)
+			i := sort.Search(len(indexer.perm), func(i int) bool {
+				return less(added, indexer.perm[i])
+			})
+			indexer.perm = append(indexer.perm, 0)
+			copy(indexer.perm[i+1:], indexer.perm[i:])
+			indexer.perm[i] = added
+		}
+	}
+	return err
+}
+
+// Lines returns the index of the lines appended so far, as NewAlphabetizer would
+// present it. It's safe to use only until the next call to Append.
+func (indexer *Indexer) Lines() LineHolder {
+	return &alphabetizer{storage: indexer.shifter, perm: indexer.perm}
+}
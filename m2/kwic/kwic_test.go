@@ -0,0 +1,150 @@
+package kwic
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestConcatHolder(t *testing.T) {
+	first, second := &LineStorage{}, &LineStorage{}
+	first.AppendLine([]byte("b"), []byte("a"))
+	second.AppendLine([]byte("c"))
+	second.AppendLine([]byte("a"), []byte("dd"))
+	concat := NewConcatHolder(first, &LineStorage{}, second)
+	if got, want := fmt.Sprint(wordsOf(concat)), "[[b a] [c] [a dd]]"; got != want {
+		t.Errorf("concatenated %s, want %s", got, want)
+	}
+	// The last line comes from the last holder, past the empty one.
+	if got := string(WordBytes(concat, concat.Lines(), 2)); got != "dd" {
+		t.Errorf("last word of the last line is %q, want dd", got)
+	}
+	if got := OriginalLineOf(concat, concat.Lines()); got != 2 {
+		t.Errorf("last line came from line %d of its holder, want 2", got)
+	}
+	want := []string{"a b", "a dd", "b a", "c", "dd a"}
+	sorted := NewAlphabetizer(NewCircularShifter(concat))
+	if sorted.Lines() != len(want) {
+		t.Fatalf("%d shifts, want %d", sorted.Lines(), len(want))
+	}
+	for line := 1; line <= sorted.Lines(); line++ {
+		if RenderLine(sorted, line) != want[line-1] {
+			t.Errorf("line %d is %q, want %q", line, RenderLine(sorted, line), want[line-1])
+		}
+	}
+	// Holders that are all empty, or none at all, have no lines.
+	for _, empty := range []LineHolder{NewConcatHolder(), NewConcatHolder(&LineStorage{}, &LineStorage{})} {
+		if empty.Lines() != 0 {
+			t.Errorf("%d lines, want 0", empty.Lines())
+		}
+	}
+	tests := []struct {
+		name  string
+		read  func()
+		panic string // a substring of the panic message
+	}{
+		{"line 0", func() { concat.Words(0) }, "line 0 is out of range: 3 holders have 3 lines"},
+		{"line past end", func() { concat.Words(4) }, "line 4 is out of range"},
+		{"word past end", func() { concat.Chars(2, 2) }, "it's line 1 of holder 3, which has 1 words"},
+		{"word 0", func() { concat.Char(1, 0, 1) }, "it's line 1 of holder 1"},
+		{"char past end", func() { concat.Char(3, 2, 3) }, "it's line 2 of holder 3, whose word has 2 characters"},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				message := fmt.Sprint(recover())
+				if !strings.Contains(message, test.panic) {
+					t.Errorf("%s: panicked with %q, want %q", test.name, message, test.panic)
+				}
+			}()
+			test.read()
+		}()
+	}
+}
+
+func TestIndexEmpty(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"\n", ""},
+		{" ", ""},
+		{"  \n \n\n", ""},
+		{"a", "a\n"},
+		{"\na\n ", "a\n"},
+	}
+	for _, test := range tests {
+		if got := indexText(t, test.text); got != test.want {
+			t.Errorf("Index(%q) wrote %q, want %q", test.text, got, test.want)
+		}
+		storage := storageOf(t, test.text)
+		for _, shifts := range []LineHolder{
+			NewCircularShifter(storage),
+			NewReverseCircularShifter(storage),
+			NewLazyCircularShifter(storage),
+		} {
+			index := NewAlphabetizer(shifts)
+			if perm := index.(*alphabetizer).perm; len(perm) != strings.Count(test.want, "\n") {
+				t.Errorf("%q: alphabetized %d shifts, want %d", test.text, len(perm), strings.Count(test.want, "\n"))
+			}
+			got := render(t, func(w io.Writer) (int64, error) { return Output(w, index) })
+			if got != test.want {
+				t.Errorf("%q: wrote %q, want %q", test.text, got, test.want)
+			}
+			render(t, func(w io.Writer) (int64, error) { return OutputAligned(w, index, 20) })
+			render(t, func(w io.Writer) (int64, error) { return OutputJSON(w, index) })
+		}
+		if got, err := IndexBatched(io.Discard, 1, InputOptions{}, strings.NewReader(test.text)); err != nil || got != int64(len(test.want)) {
+			t.Errorf("IndexBatched(%q) = %d, %v, want %d, nil", test.text, got, err, len(test.want))
+		}
+	}
+}
+
+func TestIndexerAppend(t *testing.T) {
+	texts := []string{"the quick fox\n", "", "jumped over\n\nthe lazy dog\n", "a\n", "Fox the quick\nzebra"}
+	indexer := NewIndexer(InputOptions{})
+	for i, text := range texts {
+		if err := indexer.Append(text); err != nil {
+			t.Fatalf("Append(%q): %v", text, err)
+		}
+		joined := strings.Join(texts[:i+1], "")
+		got := render(t, func(w io.Writer) (int64, error) { return OutputNumbered(w, indexer.Lines()) })
+		want := render(t, func(w io.Writer) (int64, error) {
+			return OutputNumbered(w, NewAlphabetizer(NewCircularShifter(storageOf(t, joined))))
+		})
+		if got != want {
+			t.Errorf("after %d appends, index is\n%s\nwant\n%s", i+1, got, want)
+		}
+	}
+	// Lines read before an error are indexed all the same.
+	var text strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&text, "line%d of %d\n", i*7919%2000, i)
+	}
+	compressed := gzipped(t, text.String())
+	indexer = NewIndexer(InputOptions{})
+	indexer.Append("first line\n")
+	if err := indexer.Append(string(compressed[:len(compressed)*3/4])); err == nil {
+		t.Fatalf("no error appending truncated gzip data")
+	}
+	stored := indexer.storage
+	if stored.Lines() <= 1 {
+		t.Fatalf("only %d lines stored before the error", stored.Lines())
+	}
+	got := render(t, func(w io.Writer) (int64, error) { return OutputNumbered(w, indexer.Lines()) })
+	want := render(t, func(w io.Writer) (int64, error) {
+		return OutputNumbered(w, NewAlphabetizer(NewCircularShifter(stored)))
+	})
+	if got != want {
+		t.Errorf("after an error, the index doesn't hold the shifts of the %d stored lines", stored.Lines())
+	}
+	// Appending again continues from there.
+	if err := indexer.Append("last line\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := indexer.Lines().Lines(), NewCircularShifter(stored).Lines(); got != want {
+		t.Errorf("index has %d shifts, want %d", got, want)
+	}
+}
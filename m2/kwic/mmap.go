@@ -0,0 +1,112 @@
+package kwic
+
+import (
+	"os"
+	"unicode/utf8"
+)
+
+// Module 1 (alternative): Memory-Mapped Line Storage
+
+// MmapStorage is a read-only LineHolder over a memory-mapped file. Instead of
+// copying characters like LineStorage, it records where each word lies in the
+// mapped region. Words and lines are separated as by InputFrom with the default
+// options, and words that aren't ASCII are decoded from UTF-8 in the same way.
+type MmapStorage struct {
+	data      []byte
+	array     [][]wordSpan
+	originals []int // originals[line-1] is the line of the file that line came from
+}
+
+// wordSpan locates a word within MmapStorage.data.
+type wordSpan struct {
+	start int
+	end   int    // exclusive
+	runes []rune // decoded characters, or nil if the word is ASCII
+}
+
+// NewMmapStorage maps the named file into memory and indexes its words. Call
+// Close to unmap it.
+func NewMmapStorage(filename string) (*MmapStorage, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	storage := &MmapStorage{}
+	if stat.Size() > 0 {
+		storage.data, err = mmapFile(file, int(stat.Size()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var words []wordSpan
+	start, original := 0, 1
+	for i := 0; i <= len(storage.data); i++ {
+		if i < len(storage.data) && storage.data[i] != ' ' && storage.data[i] != '\n' &&
+			!(storage.data[i] == '\r' && i+1 < len(storage.data) && storage.data[i+1] == '\n') {
+			continue
+		}
+		if i > start {
+			span := wordSpan{start: start, end: i}
+			for _, b := range storage.data[start:i] {
+				if b >= utf8.RuneSelf {
+					span.runes = []rune(string(storage.data[start:i]))
+					break
+				}
+			}
+			words = append(words, span)
+		}
+		start = i + 1
+		if i == len(storage.data) || storage.data[i] == '\n' {
+			if len(words) > 0 {
+				storage.array = append(storage.array, words)
+				storage.originals = append(storage.originals, original)
+				words = nil
+			}
+			original++
+		}
+	}
+	return storage, nil
+}
+
+// Close unmaps the file. The storage must not be used afterwards.
+func (storage *MmapStorage) Close() error {
+	if storage.data == nil {
+		return nil
+	}
+	data := storage.data
+	storage.data, storage.array, storage.originals = nil, nil, nil
+	return munmapFile(data)
+}
+
+func (storage *MmapStorage) Char(line, word, char int) rune {
+	span := storage.array[line-1][word-1]
+	if span.runes != nil {
+		return span.runes[char-1]
+	}
+	return rune(storage.data[span.start+char-1])
+}
+
+func (storage *MmapStorage) Lines() int {
+	return len(storage.array)
+}
+
+func (storage *MmapStorage) Words(line int) int {
+	return len(storage.array[line-1])
+}
+
+func (storage *MmapStorage) Chars(line, word int) int {
+	span := storage.array[line-1][word-1]
+	if span.runes != nil {
+		return len(span.runes)
+	}
+	return span.end - span.start
+}
+
+func (storage *MmapStorage) OriginalLine(line int) int {
+	return storage.originals[line-1]
+}
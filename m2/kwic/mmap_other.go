@@ -0,0 +1,18 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package kwic
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoMmap = errors.New("memory-mapped input is not supported on this platform")
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errNoMmap
+}
+
+func munmapFile(data []byte) error {
+	return errNoMmap
+}
@@ -0,0 +1,55 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package kwic
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapStorage(t *testing.T) {
+	tests := []string{
+		"",
+		"one\n",
+		"the quick brown fox\njumped over\nthe lazy dog",
+		"  leading and  double spaces \n\n\nafter blank lines\n",
+		"windows\r\nline endings\r\n",
+		"a\rbare carriage return\n",
+		"café crème\nÉclair 日本語\n",
+		"\xffinvalid\xfe utf-8\n",
+	}
+	for _, text := range tests {
+		path := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mapped, err := NewMmapStorage(path)
+		if err != nil {
+			t.Fatalf("NewMmapStorage: %v", err)
+		}
+		want := storageOf(t, text)
+		if mapped.Lines() != want.Lines() {
+			t.Errorf("%q: mapped %d lines, want %d", text, mapped.Lines(), want.Lines())
+		}
+		for line := 1; line <= mapped.Lines() && line <= want.Lines(); line++ {
+			if mapped.OriginalLine(line) != want.OriginalLine(line) {
+				t.Errorf("%q: line %d came from line %d, want %d",
+					text, line, mapped.OriginalLine(line), want.OriginalLine(line))
+			}
+		}
+		got := render(t, func(w io.Writer) (int64, error) {
+			return OutputNumbered(w, NewAlphabetizer(NewCircularShifter(mapped)))
+		})
+		wantOutput := render(t, func(w io.Writer) (int64, error) {
+			return OutputNumbered(w, NewAlphabetizer(NewCircularShifter(want)))
+		})
+		if got != wantOutput {
+			t.Errorf("%q: mapped index is\n%s\nwant\n%s", text, got, wantOutput)
+		}
+		if err := mapped.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}
+}
@@ -0,0 +1,912 @@
+package kwic
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Module 5: Output
+
+// markedHolder surrounds the keyword of each line of another LineHolder with
+// left and right markers, as if they were part of the word.
+type markedHolder struct {
+	storage     LineHolder
+	left, right []rune
+}
+
+// NewMarkedHolder surrounds the keyword of each line of lines with left and
+// right. The markers are only for display: output functions that show how
+// lines sort, such as OutputKeys, look through them to the unmarked lines.
+func NewMarkedHolder(lines LineHolder, left, right string) LineHolder {
+	return &markedHolder{lines, []rune(left), []rune(right)}
+}
+
+// unmarked returns lines without any markers added by NewMarkedHolder.
+func unmarked(lines LineHolder) LineHolder {
+	for {
+		marked, ok := lines.(*markedHolder)
+		if !ok {
+			return lines
+		}
+		lines = marked.storage
+	}
+}
+
+func (marked *markedHolder) Char(line, word, char int) rune {
+	if word != KeywordOf(marked.storage, line) {
+		return marked.storage.Char(line, word, char)
+	}
+	if char <= len(marked.left) {
+		return marked.left[char-1]
+	}
+	char -= len(marked.left)
+	chars := marked.storage.Chars(line, word)
+	if char <= chars {
+		return marked.storage.Char(line, word, char)
+	}
+	return marked.right[char-chars-1]
+}
+
+func (marked *markedHolder) Lines() int {
+	return marked.storage.Lines()
+}
+
+func (marked *markedHolder) Words(line int) int {
+	return marked.storage.Words(line)
+}
+
+func (marked *markedHolder) Chars(line, word int) int {
+	chars := marked.storage.Chars(line, word)
+	if word == KeywordOf(marked.storage, line) {
+		chars += len(marked.left) + len(marked.right)
+	}
+	return chars
+}
+
+func (marked *markedHolder) OriginalLine(line int) int {
+	return OriginalLineOf(marked.storage, line)
+}
+
+func (marked *markedHolder) StartWord(line int) int {
+	return StartWordOf(marked.storage, line)
+}
+
+func (marked *markedHolder) Keyword(line int) int {
+	return KeywordOf(marked.storage, line)
+}
+
+// cacheHolder remembers the numbers of words and characters in the lines of
+// another LineHolder, so that output doesn't recompute them through every
+// module for each character.
+type cacheHolder struct {
+	storage LineHolder
+	chars   [][]int // chars[line-1][word-1], so len(chars[line-1]) is words
+}
+
+// NewCacheHolder presents the lines of lines, computing the number of words in
+// each line and characters in each word once, up front. Characters are still
+// read from lines as needed.
+func NewCacheHolder(lines LineHolder) LineHolder {
+	cache := &cacheHolder{storage: lines, chars: make([][]int, lines.Lines())}
+	for line := range cache.chars {
+		cache.chars[line] = make([]int, lines.Words(line+1))
+		for word := range cache.chars[line] {
+			cache.chars[line][word] = lines.Chars(line+1, word+1)
+		}
+	}
+	return cache
+}
+
+func (cache *cacheHolder) Char(line, word, char int) rune {
+	return cache.storage.Char(line, word, char)
+}
+
+func (cache *cacheHolder) Lines() int {
+	return len(cache.chars)
+}
+
+func (cache *cacheHolder) Words(line int) int {
+	return len(cache.chars[line-1])
+}
+
+func (cache *cacheHolder) Chars(line, word int) int {
+	return cache.chars[line-1][word-1]
+}
+
+func (cache *cacheHolder) OriginalLine(line int) int {
+	return OriginalLineOf(cache.storage, line)
+}
+
+func (cache *cacheHolder) StartWord(line int) int {
+	return StartWordOf(cache.storage, line)
+}
+
+func (cache *cacheHolder) Keyword(line int) int {
+	return KeywordOf(cache.storage, line)
+}
+
+// Output writes each line of lines with its words separated by spaces. It
+// returns the number of bytes written and the first error encountered.
+//
+// Like the other output functions, Output collects what it writes in a buffer
+// of its own, which it passes on to w whenever it fills and once more before
+// returning, so w sees a few large writes. It never flushes w itself, so a
+// caller that passes a *bufio.Writer, perhaps to write several outputs
+// together, decides when the output goes on from there.
+func Output(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		out.WriteString(RenderLine(lines, line))
+		out.WriteByte('\n')
+	}
+	return out.finish()
+}
+
+// RenderLine returns a line of lines as Output writes it, with its words
+// separated by spaces and without a line terminator.
+func RenderLine(lines LineHolder, line int) string {
+	var sb strings.Builder
+	sb.Grow(LineChars(lines, line))
+	for word := 1; word <= lines.Words(line); word++ {
+		if word > 1 {
+			sb.WriteByte(' ')
+		}
+		for char := 1; char <= lines.Chars(line, word); char++ {
+			sb.WriteRune(lines.Char(line, word, char))
+		}
+	}
+	return sb.String()
+}
+
+// RenderAll returns every line of lines as RenderLine does.
+func RenderAll(lines LineHolder) []string {
+	rendered := make([]string, lines.Lines())
+	for line := range rendered {
+		rendered[line] = RenderLine(lines, line+1)
+	}
+	return rendered
+}
+
+// OutputParallel writes the same bytes as Output, but renders contiguous ranges
+// of lines concurrently on up to workers goroutines. It requires that lines be
+// safe for concurrent reads.
+func OutputParallel(w io.Writer, lines LineHolder, workers int) (int64, error) {
+	if workers > lines.Lines() {
+		workers = lines.Lines()
+	}
+	if workers <= 1 {
+		return Output(w, lines)
+	}
+	buffers := make([]bytes.Buffer, workers)
+	var wg sync.WaitGroup
+	for i := range buffers {
+		first := 1 + i*lines.Lines()/workers
+		last := (i + 1) * lines.Lines() / workers
+		wg.Add(1)
+		go func(buffer *bytes.Buffer) {
+			defer wg.Done()
+			for line := first; line <= last; line++ {
+				writeLine(buffer, lines, line)
+				buffer.WriteByte('\n')
+			}
+		}(&buffers[i])
+	}
+	wg.Wait()
+	out := newOutputWriter(w)
+	for i := range buffers {
+		out.Write(buffers[i].Bytes())
+	}
+	return out.finish()
+}
+
+// countingWriter counts the bytes written to w. It remembers the first error,
+// including short writes, and writes nothing after that.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	cw.err = err
+	return n, err
+}
+
+// outputWriter buffers the writes of an output function and counts the bytes
+// it passes on to the underlying writer.
+type outputWriter struct {
+	*bufio.Writer
+	counter *countingWriter
+}
+
+func newOutputWriter(w io.Writer) *outputWriter {
+	counter := &countingWriter{w: w}
+	return &outputWriter{bufio.NewWriter(counter), counter}
+}
+
+// ok reports whether every write to the underlying writer so far has
+// succeeded. Output functions stop early once one hasn't.
+func (out *outputWriter) ok() bool {
+	return out.counter.err == nil
+}
+
+// finish flushes the buffer and returns the number of bytes written and the
+// first error encountered.
+func (out *outputWriter) finish() (int64, error) {
+	err := out.Flush()
+	return out.counter.n, err
+}
+
+// writeLine writes the words of a line in UTF-8 separated by spaces, without a
+// line terminator.
+func writeLine(w io.Writer, lines LineHolder, line int) {
+	var buf [utf8.UTFMax]byte
+	for word := 1; word <= lines.Words(line); word++ {
+		for char := 1; char <= lines.Chars(line, word); char++ {
+			w.Write(buf[:utf8.EncodeRune(buf[:], lines.Char(line, word, char))])
+		}
+		if word < lines.Words(line) {
+			w.Write([]byte{' '})
+		}
+	}
+}
+
+// OutputPrefixed writes lines in the length-prefixed format read by
+// InputPrefixed.
+func OutputPrefixed(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		for word := 1; word <= lines.Words(line); word++ {
+			fmt.Fprintf(out, "%d:", lines.Chars(line, word))
+			out.Write(WordBytes(lines, line, word))
+			if word < lines.Words(line) {
+				out.Write([]byte{' '})
+			}
+		}
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// OutputCSV writes one CSV record per line with the line's keyword and the rest
+// of its words as context, optionally preceded by a "keyword,context" header.
+// Fields are separated by comma and quoted as in RFC 4180.
+func OutputCSV(w io.Writer, lines LineHolder, header bool, comma rune) (int64, error) {
+	out := newOutputWriter(w)
+	writer := csv.NewWriter(out)
+	writer.Comma = comma
+	if header {
+		writer.Write([]string{"keyword", "context"})
+	}
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		if lines.Words(line) == 0 {
+			writer.Write([]string{"", ""})
+			continue
+		}
+		keyword := KeywordOf(lines, line)
+		context := []string{}
+		for word := 1; word <= lines.Words(line); word++ {
+			if word != keyword {
+				context = append(context, string(WordBytes(lines, line, word)))
+			}
+		}
+		writer.Write([]string{
+			string(WordBytes(lines, line, keyword)),
+			strings.Join(context, " "),
+		})
+	}
+	writer.Flush()
+	n, err := out.finish()
+	if err == nil {
+		err = writer.Error()
+	}
+	return n, err
+}
+
+// OutputCSVSplit is like OutputCSV but splits the context into the words before
+// and after the keyword in the unrotated line, and adds the number of the input
+// line the entry came from, if known, as a fourth field. Its header is
+// "keyword,before,after,line".
+func OutputCSVSplit(w io.Writer, lines LineHolder, header bool, comma rune) (int64, error) {
+	out := newOutputWriter(w)
+	writer := csv.NewWriter(out)
+	writer.Comma = comma
+	if header {
+		writer.Write([]string{"keyword", "before", "after", "line"})
+	}
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		source := ""
+		if original := OriginalLineOf(lines, line); original > 0 {
+			source = strconv.Itoa(original)
+		}
+		words := lines.Words(line)
+		if words == 0 {
+			writer.Write([]string{"", "", "", source})
+			continue
+		}
+		// Word j of the line is word (j+start-2)%words+1 of the unrotated
+		// line, and word i of the unrotated line is word
+		// (i-start+words)%words+1 of the line.
+		start := StartWordOf(lines, line)
+		keyword := KeywordOf(lines, line)
+		position := (keyword+start-2)%words + 1
+		before, after := []string{}, []string{}
+		for i := 1; i <= words; i++ {
+			word := string(WordBytes(lines, line, (i-start+words)%words+1))
+			if i < position {
+				before = append(before, word)
+			} else if i > position {
+				after = append(after, word)
+			}
+		}
+		writer.Write([]string{
+			string(WordBytes(lines, line, keyword)),
+			strings.Join(before, " "),
+			strings.Join(after, " "),
+			source,
+		})
+	}
+	writer.Flush()
+	n, err := out.finish()
+	if err == nil {
+		err = writer.Error()
+	}
+	return n, err
+}
+
+// jsonEntry is the form of each line written by OutputJSON.
+type jsonEntry struct {
+	Keyword     string   `json:"keyword"`
+	Words       []string `json:"words"`
+	ShiftedText string   `json:"shiftedText"`
+	SourceLine  int      `json:"sourceLine"`
+	StartWord   int      `json:"startWord"`
+}
+
+// OutputJSON writes lines as a JSON array with one object per line. Each object
+// has the line's keyword as "keyword", its words as "words", the words joined
+// by spaces as "shiftedText", the word of the unrotated line that it begins
+// with as "startWord", and the number of the input line it came from as
+// "sourceLine", or 0 if that isn't known. Every object has every field. Lines
+// are encoded one at a time, so the whole array is never held in memory.
+func OutputJSON(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	out.Write([]byte{'['})
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		entry := jsonEntry{
+			Words:      make([]string, lines.Words(line)),
+			SourceLine: OriginalLineOf(lines, line),
+			StartWord:  StartWordOf(lines, line),
+		}
+		for word := range entry.Words {
+			entry.Words[word] = string(WordBytes(lines, line, word+1))
+		}
+		entry.ShiftedText = strings.Join(entry.Words, " ")
+		if len(entry.Words) > 0 {
+			entry.Keyword = entry.Words[KeywordOf(lines, line)-1]
+		}
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			out.finish()
+			return out.counter.n, err
+		}
+		if line > 1 {
+			out.Write([]byte{','})
+		}
+		out.Write([]byte{'\n'})
+		out.Write(encoded)
+	}
+	out.Write([]byte("\n]\n"))
+	return out.finish()
+}
+
+// OutputHTML writes lines as the rows of an HTML table, with each keyword in a
+// strong element. If the input line an entry came from is known, the row begins
+// with its number, linked to the anchor "#line-N" for line N, so that the table
+// can be published next to a copy of the input with such anchors.
+func OutputHTML(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	out.WriteString("<table>\n")
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		out.WriteString("<tr><td>")
+		if original := OriginalLineOf(lines, line); original > 0 {
+			fmt.Fprintf(out, `<a href="#line-%d">%d</a>`, original, original)
+		}
+		out.WriteString("</td><td>")
+		keyword := KeywordOf(lines, line)
+		for word := 1; word <= lines.Words(line); word++ {
+			if word > 1 {
+				out.WriteByte(' ')
+			}
+			escaped := html.EscapeString(string(WordBytes(lines, line, word)))
+			if word == keyword {
+				escaped = "<strong>" + escaped + "</strong>"
+			}
+			out.WriteString(escaped)
+		}
+		out.WriteString("</td></tr>\n")
+	}
+	out.WriteString("</table>\n")
+	return out.finish()
+}
+
+// Field widths used by OutputPtx, as traditional ptx uses them.
+const (
+	ptxFieldWidth = 33 // the widest the before and keyafter fields can be
+	ptxGap        = 3  // the columns between fields as typeset
+	ptxHalfWidth  = 36 // half the width of a typeset line
+)
+
+// OutputPtx writes lines as the roff permuted index entries that GNU ptx writes
+// in its traditional mode, "ptx -G", for a line-by-line index. Each entry is
+//
+//	.xx "tail" "before" "keyafter" "head"
+//
+// where keyafter is the keyword and the words after it in the unrotated line,
+// before is the words before it, and what doesn't fit wraps around into tail
+// and head. Truncated fields are marked with "/". Sorted by KeywordLess, the
+// entries for lines of single-spaced ASCII words match those of ptx.
+func OutputPtx(w io.Writer, lines LineHolder) (int64, error) {
+	// ptx looks only so far back from a keyword for the before and head
+	// fields, depending on the longest word in the input.
+	longest := 0
+	for line := 1; line <= lines.Lines(); line++ {
+		for word := 1; word <= lines.Words(line); word++ {
+			longest = max(longest, lines.Chars(line, word))
+		}
+	}
+	out := newOutputWriter(w)
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		words := lines.Words(line)
+		if words == 0 {
+			continue
+		}
+		// Lay out the unrotated line, with its words separated by single
+		// spaces, to measure the fields in characters as ptx does in bytes.
+		start := StartWordOf(lines, line)
+		keyword := (KeywordOf(lines, line)+start-2)%words + 1
+		text := []rune{}
+		keyStart, keyEnd := 0, 0
+		for i := 1; i <= words; i++ {
+			if i > 1 {
+				text = append(text, ' ')
+			}
+			if i == keyword {
+				keyStart = len(text)
+			}
+			text = append(text, []rune(string(WordBytes(lines, line, (i-start+words)%words+1)))...)
+			if i == keyword {
+				keyEnd = len(text)
+			}
+		}
+		writePtxEntry(out, text, keyStart, keyEnd, ptxHalfWidth+longest)
+	}
+	return out.finish()
+}
+
+// writePtxEntry writes the entry for the keyword text[keyStart:keyEnd], fitting
+// the fields around it as ptx does. The before and head fields begin no more
+// than reach characters before the keyword.
+func writePtxEntry(w io.Writer, text []rune, keyStart, keyEnd, reach int) {
+	end := len(text)
+	// skip advances past a word or a single space.
+	skip := func(cursor, limit int) int {
+		if text[cursor] != ' ' {
+			for cursor < limit && text[cursor] != ' ' {
+				cursor++
+			}
+			return cursor
+		}
+		return cursor + 1
+	}
+	skipSpace := func(cursor, limit int) int {
+		for cursor < limit && text[cursor] == ' ' {
+			cursor++
+		}
+		return cursor
+	}
+	skipSpaceBack := func(cursor, limit int) int {
+		for cursor > limit && text[cursor-1] == ' ' {
+			cursor--
+		}
+		return cursor
+	}
+
+	// keyafter takes as many words after the keyword as fit.
+	afterEnd := keyEnd
+	cursor := keyEnd
+	for cursor < end && cursor <= keyStart+ptxFieldWidth {
+		afterEnd = cursor
+		cursor = skip(cursor, end)
+	}
+	if cursor <= keyStart+ptxFieldWidth {
+		afterEnd = cursor
+	}
+	afterCut := afterEnd < end
+	afterEnd = skipSpaceBack(afterEnd, keyStart)
+
+	leftStart := 0
+	if keyStart > reach {
+		leftStart = skip(keyStart-reach, keyStart)
+	}
+
+	// before takes as many words just before the keyword as fit.
+	beforeStart, beforeEnd := leftStart, skipSpaceBack(keyStart, 0)
+	for beforeStart+ptxFieldWidth < beforeEnd {
+		beforeStart = skip(beforeStart, beforeEnd)
+	}
+	beforeCut := skipSpaceBack(beforeStart, 0) > 0
+	beforeStart = skipSpace(beforeStart, end)
+
+	// tail takes the words after keyafter that fit in what before leaves.
+	tailStart, tailEnd, tailCut := 0, 0, false
+	if tailWidth := ptxFieldWidth - (beforeEnd - beforeStart) - ptxGap; tailWidth > 0 {
+		tailStart = skipSpace(afterEnd, end)
+		tailEnd = tailStart
+		cursor = tailStart
+		for cursor < end && cursor < tailStart+tailWidth {
+			tailEnd = cursor
+			cursor = skip(cursor, end)
+		}
+		if cursor < tailStart+tailWidth {
+			tailEnd = cursor
+		}
+		if tailEnd > tailStart {
+			afterCut = false
+			tailCut = tailEnd < end
+		}
+		tailEnd = skipSpaceBack(tailEnd, tailStart)
+	}
+
+	// head takes the words before before that fit in what keyafter leaves.
+	headStart, headEnd, headCut := 0, 0, false
+	if headWidth := ptxFieldWidth - (afterEnd - keyStart) - ptxGap; headWidth > 0 {
+		headStart = leftStart
+		headEnd = skipSpaceBack(beforeStart, 0)
+		for headStart+headWidth < headEnd {
+			headStart = skip(headStart, headEnd)
+		}
+		if headEnd > headStart {
+			beforeCut = false
+			headCut = headStart > 0
+		}
+		headStart = skipSpace(headStart, headEnd)
+	}
+
+	field := func(start, end int, cutBefore, cutAfter bool) string {
+		quoted := ""
+		if cutBefore {
+			quoted = "/"
+		}
+		if start < end {
+			quoted += strings.ReplaceAll(string(text[start:end]), `"`, `""`)
+		}
+		if cutAfter {
+			quoted += "/"
+		}
+		return `"` + quoted + `"`
+	}
+	fmt.Fprintf(w, ".xx %s %s %s %s\n",
+		field(tailStart, tailEnd, false, tailCut),
+		field(beforeStart, beforeEnd, beforeCut, false),
+		field(keyStart, afterEnd, false, afterCut),
+		field(headStart, headEnd, headCut, false))
+}
+
+// reversedHolder presents the words of each line of another LineHolder in
+// reverse order.
+type reversedHolder struct {
+	storage LineHolder
+}
+
+func (reversed *reversedHolder) Char(line, word, char int) rune {
+	return reversed.storage.Char(line, reversed.storage.Words(line)-word+1, char)
+}
+
+func (reversed *reversedHolder) Lines() int {
+	return reversed.storage.Lines()
+}
+
+func (reversed *reversedHolder) Words(line int) int {
+	return reversed.storage.Words(line)
+}
+
+func (reversed *reversedHolder) Chars(line, word int) int {
+	return reversed.storage.Chars(line, reversed.storage.Words(line)-word+1)
+}
+
+func (reversed *reversedHolder) OriginalLine(line int) int {
+	return OriginalLineOf(reversed.storage, line)
+}
+
+func (reversed *reversedHolder) StartWord(line int) int {
+	return StartWordOf(reversed.storage, line)
+}
+
+func (reversed *reversedHolder) Keyword(line int) int {
+	return reversed.storage.Words(line) - KeywordOf(reversed.storage, line) + 1
+}
+
+// rightToLeftMark is the Unicode RIGHT-TO-LEFT MARK (U+200F).
+const rightToLeftMark = "\u200f"
+
+// OutputRTL is like Output but, for right-to-left scripts, writes the words of
+// each line in reverse order after a right-to-left mark.
+func OutputRTL(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	reversed := &reversedHolder{lines}
+	for line := 1; line <= reversed.Lines() && out.ok(); line++ {
+		out.Write([]byte(rightToLeftMark))
+		writeLine(out, reversed, line)
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// OutputHashed is like Output but prefixes each line with the first 8 hex digits
+// of the SHA-256 hash of its text and a tab, so that changed entries can be
+// detected between runs.
+func OutputHashed(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	var buffer bytes.Buffer
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		buffer.Reset()
+		writeLine(&buffer, lines, line)
+		sum := sha256.Sum256(buffer.Bytes())
+		fmt.Fprintf(out, "%x\t", sum[:4])
+		out.Write(buffer.Bytes())
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// OutputKeys is like Output but prefixes each line with the NormalizeChar values
+// of its keyword in hex, separated by periods, and a tab, to show why lines sort
+// as they do. Keys are of the keywords without any markers from
+// NewMarkedHolder, though the lines are written with them.
+func OutputKeys(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	keys := unmarked(lines)
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		if keys.Words(line) > 0 {
+			keyword := KeywordOf(keys, line)
+			for char := 1; char <= keys.Chars(line, keyword); char++ {
+				if char > 1 {
+					out.Write([]byte{'.'})
+				}
+				fmt.Fprintf(out, "%x", NormalizeChar(keys.Char(line, keyword, char)))
+			}
+		}
+		out.Write([]byte{'\t'})
+		writeLine(out, lines, line)
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// OutputIndented is like Output but prefixes each line with one copy of unit
+// for each word the line was rotated from its original.
+func OutputIndented(w io.Writer, lines LineHolder, unit string) (int64, error) {
+	out := newOutputWriter(w)
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		for i := 1; i < StartWordOf(lines, line); i++ {
+			out.Write([]byte(unit))
+		}
+		writeLine(out, lines, line)
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// ellipsis marks where OutputAligned truncated context.
+const ellipsis = "..."
+
+// OutputAligned writes lines as a traditional KWIC index, with each keyword
+// starting in column width+2. The words that preceded the keyword in its
+// unrotated line are right-justified in the first width columns, and the
+// keyword and the words that followed it are left-justified after a space. Either
+// side is truncated with an ellipsis if it's longer than width characters.
+func OutputAligned(w io.Writer, lines LineHolder, width int) (int64, error) {
+	out := newOutputWriter(w)
+	var before, after []rune
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		before, after = before[:0], after[:0]
+		// Lay out the words in their unrotated order, splitting them at
+		// the keyword's place there.
+		words := lines.Words(line)
+		start := StartWordOf(lines, line)
+		keyword := (KeywordOf(lines, line)+start-2)%max(words, 1) + 1
+		for unrotated := 1; unrotated <= words; unrotated++ {
+			word := (unrotated-start+words)%words + 1
+			context := &after
+			if unrotated < keyword {
+				context = &before
+			}
+			if len(*context) > 0 {
+				*context = append(*context, ' ')
+			}
+			for char := 1; char <= lines.Chars(line, word); char++ {
+				*context = append(*context, lines.Char(line, word, char))
+			}
+		}
+		left := elide(before, width, true)
+		for i := len(left); i < width; i++ {
+			out.Write([]byte{' '})
+		}
+		out.Write([]byte(string(left)))
+		out.Write([]byte{' '})
+		out.Write([]byte(string(elide(after, width, false))))
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// elide shortens text to at most width characters, replacing its beginning (if
+// fromLeft) or its end with an ellipsis.
+func elide(text []rune, width int, fromLeft bool) []rune {
+	if len(text) <= width {
+		return text
+	}
+	if width <= len(ellipsis) {
+		return []rune(ellipsis[:max(width, 0)])
+	}
+	if fromLeft {
+		return append([]rune(ellipsis), text[len(text)-width+len(ellipsis):]...)
+	}
+	return append(text[:width-len(ellipsis):width-len(ellipsis)], []rune(ellipsis)...)
+}
+
+// OutputNumbered is like Output but prefixes each line with the number of the
+// input line it came from and a tab, or with nothing if that isn't known.
+func OutputNumbered(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		if original := OriginalLineOf(lines, line); original > 0 {
+			fmt.Fprintf(out, "%d\t", original)
+		}
+		writeLine(out, lines, line)
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// OutputNumberedAfter is like OutputNumbered but puts the number of the input
+// line after each line, following a tab.
+func OutputNumberedAfter(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		writeLine(out, lines, line)
+		if original := OriginalLineOf(lines, line); original > 0 {
+			fmt.Fprintf(out, "\t%d", original)
+		}
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// OutputCounted is like Output but writes each run of consecutive lines that are
+// LinesEqual once, prefixed with the number of lines in the run and a tab, as
+// "uniq -c" does. Given alphabetized lines, it counts every repeated entry.
+func OutputCounted(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	for line := 1; line <= lines.Lines() && out.ok(); {
+		count := 1
+		for line+count <= lines.Lines() && LinesEqual(lines, line, line+count) {
+			count++
+		}
+		fmt.Fprintf(out, "%d\t", count)
+		writeLine(out, lines, line)
+		out.Write([]byte{'\n'})
+		line += count
+	}
+	return out.finish()
+}
+
+// SortKey returns a string that orders lines of any LineHolder the same way
+// LinesLess does when compared bytewise, beginning with each line's keyword as
+// NewAlphabetizer does. Each character is encoded as 14 hex digits of its
+// NormalizeChar value plus one, and each word ends with 14 zeros.
+func SortKey(lines LineHolder, line int) string {
+	lines = keywordFirst(lines)
+	var key strings.Builder
+	for word := 1; word <= lines.Words(line); word++ {
+		for char := 1; char <= lines.Chars(line, word); char++ {
+			fmt.Fprintf(&key, "%014x", NormalizeChar(lines.Char(line, word, char))+1)
+		}
+		key.WriteString("00000000000000")
+	}
+	return key.String()
+}
+
+// OutputPartial writes each line as its SortKey, a tab, and its text. When lines
+// is alphabetized, the result can be combined with other partial outputs using
+// MergePartials.
+func OutputPartial(w io.Writer, lines LineHolder) (int64, error) {
+	out := newOutputWriter(w)
+	for line := 1; line <= lines.Lines() && out.ok(); line++ {
+		out.Write([]byte(SortKey(lines, line)))
+		out.Write([]byte{'\t'})
+		writeLine(out, lines, line)
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// MergePartials merges the output of OutputPartial from several inputs into the
+// text output of the combined index. Entries with equal keys are ordered by
+// their text.
+func MergePartials(w io.Writer, partials []io.Reader) (int64, error) {
+	type head struct {
+		reader    *bufio.Reader
+		key, text string
+		ok        bool
+	}
+	advance := func(h *head) error {
+		entry, err := h.reader.ReadString('\n')
+		if err == io.EOF && entry == "" {
+			h.ok = false
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		tab := strings.IndexByte(entry, '\t')
+		if tab < 0 {
+			return fmt.Errorf("malformed partial entry %q", entry)
+		}
+		h.key, h.text, h.ok = entry[:tab], strings.TrimSuffix(entry[tab+1:], "\n"), true
+		return nil
+	}
+	heads := make([]head, len(partials))
+	for i, partial := range partials {
+		heads[i].reader = bufio.NewReader(partial)
+		err := advance(&heads[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	out := newOutputWriter(w)
+	for {
+		next := -1
+		for i := range heads {
+			if !heads[i].ok {
+				continue
+			}
+			if next < 0 || heads[i].key < heads[next].key ||
+				heads[i].key == heads[next].key && heads[i].text < heads[next].text {
+				next = i
+			}
+		}
+		if next < 0 {
+			return out.finish()
+		}
+		out.Write([]byte(heads[next].text))
+		out.Write([]byte{'\n'})
+		if !out.ok() {
+			return out.finish()
+		}
+		err := advance(&heads[next])
+		if err != nil {
+			out.finish()
+			return out.counter.n, err
+		}
+	}
+}
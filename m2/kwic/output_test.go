@@ -0,0 +1,492 @@
+package kwic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// indexText returns the output of Index for text.
+func indexText(t *testing.T, text string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := Index(strings.NewReader(text), &out); err != nil {
+		t.Fatalf("Index(%q): %v", text, err)
+	}
+	return out.String()
+}
+
+// storageOf returns storage holding text as InputFrom reads it by default.
+func storageOf(t *testing.T, text string) *LineStorage {
+	t.Helper()
+	storage := &LineStorage{}
+	if err := InputFrom(strings.NewReader(text), storage, InputOptions{}); err != nil {
+		t.Fatalf("InputFrom(%q): %v", text, err)
+	}
+	return storage
+}
+
+// render returns what output writes, checking that it reports writing every
+// byte without an error.
+func render(t *testing.T, output func(w io.Writer) (int64, error)) string {
+	t.Helper()
+	var out bytes.Buffer
+	n, err := output(&out)
+	if err != nil {
+		t.Fatalf("output failed: %v", err)
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("output reported writing %d bytes, but wrote %d", n, out.Len())
+	}
+	return out.String()
+}
+
+func TestOutputIndented(t *testing.T) {
+	shifts := NewCircularShifter(storageOf(t, "a b c d\nx\n"))
+	tests := []struct {
+		name  string
+		lines LineHolder
+		want  string
+	}{
+		{"shifts", shifts, "a b c d\n..b c d a\n....c d a b\n......d a b c\nx\n"},
+		{"sorted", NewAlphabetizerDesc(shifts), "x\n......d a b c\n....c d a b\n..b c d a\na b c d\n"},
+	}
+	for _, test := range tests {
+		got := render(t, func(w io.Writer) (int64, error) {
+			return OutputIndented(w, test.lines, "..")
+		})
+		if got != test.want {
+			t.Errorf("%s: wrote %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergePartials(t *testing.T) {
+	const text = "the quick brown fox\nJumped over\nthe lazy dog\nÉclair au café\nfox 10 fox 9\n"
+	storage := &LineStorage{}
+	if err := InputFrom(strings.NewReader(text), storage, InputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for split := 0; split <= storage.Lines(); split++ {
+		var first, second bytes.Buffer
+		for _, part := range []struct {
+			w         io.Writer
+			low, high int
+		}{{&first, 1, split}, {&second, split + 1, storage.Lines()}} {
+			lines := NewLineFilter(storage, func(line int) bool {
+				return line >= part.low && line <= part.high
+			})
+			if _, err := OutputPartial(part.w, NewAlphabetizer(NewCircularShifter(lines))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var merged bytes.Buffer
+		if _, err := MergePartials(&merged, []io.Reader{&first, &second}); err != nil {
+			t.Fatal(err)
+		}
+		if want := indexText(t, text); merged.String() != want {
+			t.Errorf("split after line %d: merged\n%s\nwant\n%s", split, merged.String(), want)
+		}
+	}
+}
+
+func TestSortKey(t *testing.T) {
+	storage := &LineStorage{}
+	for _, line := range []string{"b", "a b", "a", "A", "á", "a a", "10", "9", "zz", "Ω"} {
+		storage.AppendLine([]byte(line))
+		storage.AppendLine(bytes.Fields([]byte(line))...)
+	}
+	for line1 := 1; line1 <= storage.Lines(); line1++ {
+		for line2 := 1; line2 <= storage.Lines(); line2++ {
+			less := LinesLess(storage, line1, line2)
+			if keyLess := SortKey(storage, line1) < SortKey(storage, line2); keyLess != less {
+				t.Errorf("SortKey orders %q < %q as %v, LinesLess as %v",
+					RenderLine(storage, line1), RenderLine(storage, line2), keyLess, less)
+			}
+		}
+	}
+}
+
+func TestOutputNumbered(t *testing.T) {
+	storage := &LineStorage{}
+	if err := InputFrom(strings.NewReader("alpha\n\n\nbeta gamma\n"), storage, InputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	lines := NewAlphabetizer(NewCircularShifter(storage))
+	tests := []struct {
+		name   string
+		output func(w io.Writer, lines LineHolder) (int64, error)
+		want   string
+	}{
+		{"before", OutputNumbered, "1\talpha\n4\tbeta gamma\n4\tgamma beta\n"},
+		{"after", OutputNumberedAfter, "alpha\t1\nbeta gamma\t4\ngamma beta\t4\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		n, err := test.output(&out, lines)
+		if err != nil || out.String() != test.want || n != int64(out.Len()) {
+			t.Errorf("%s: wrote %q (%d bytes, error %v), want %q", test.name, out.String(), n, err, test.want)
+		}
+	}
+}
+
+func TestMarkedHolder(t *testing.T) {
+	storage := storageOf(t, "a b c\nb b\n")
+	tests := []struct {
+		name  string
+		lines LineHolder
+		want  []string
+	}{
+		{"shifts", NewCircularShifter(storage), []string{"«a» b c", "«b» c a", "«c» a b", "«b» b", "«b» b"}},
+		{"reverse shifts", NewReverseCircularShifter(storage), []string{"b c «a»", "c a «b»", "a b «c»", "b «b»", "b «b»"}},
+		{"sorted", NewAlphabetizer(NewCircularShifter(storage)), []string{"«a» b c", "«b» b", "«b» b", "«b» c a", "«c» a b"}},
+	}
+	for _, test := range tests {
+		marked := NewMarkedHolder(test.lines, "«", "»")
+		if marked.Lines() != len(test.want) {
+			t.Fatalf("%s: %d lines, want %d", test.name, marked.Lines(), len(test.want))
+		}
+		for line := 1; line <= marked.Lines(); line++ {
+			if got := RenderLine(marked, line); got != test.want[line-1] {
+				t.Errorf("%s: line %d is %q, want %q", test.name, line, got, test.want[line-1])
+			}
+		}
+	}
+}
+
+// corpus returns storage holding n lines of several words each, with words
+// repeating across lines as in real text.
+func corpus(n int) *LineStorage {
+	storage := &LineStorage{}
+	for i := 0; i < n; i++ {
+		storage.AppendLine(
+			[]byte(fmt.Sprintf("word%d", i*7%1009)),
+			[]byte(fmt.Sprintf("the%d", i%13)),
+			[]byte(fmt.Sprintf("Context%d", i*31%4093)),
+			[]byte("ending"))
+	}
+	return storage
+}
+
+func TestOutputParallel(t *testing.T) {
+	for _, n := range []int{0, 1, 5, 1000} {
+		index := NewAlphabetizer(NewCircularShifter(corpus(n)))
+		want := render(t, func(w io.Writer) (int64, error) {
+			return Output(w, index)
+		})
+		for _, workers := range []int{-1, 0, 1, 2, 3, 7, 100, 10000} {
+			got := render(t, func(w io.Writer) (int64, error) {
+				return OutputParallel(w, index, workers)
+			})
+			if got != want {
+				t.Errorf("%d lines on %d workers: output differs from Output", n, workers)
+			}
+		}
+	}
+}
+
+func benchmarkOutput(b *testing.B, output func(w io.Writer, lines LineHolder) (int64, error)) {
+	benchmarkOutputCache(b, false, output)
+}
+
+func BenchmarkOutput(b *testing.B) {
+	benchmarkOutput(b, Output)
+}
+
+func BenchmarkOutputParallel(b *testing.B) {
+	workers := runtime.GOMAXPROCS(0)
+	benchmarkOutput(b, func(w io.Writer, lines LineHolder) (int64, error) {
+		return OutputParallel(w, lines, workers)
+	})
+}
+
+func TestOutputCSV(t *testing.T) {
+	lines := StorageFromLines([][]string{
+		{"a,b", "plain"},
+		{"x", `say "hi"`},
+		{"semi;colon", "c"},
+		{"new\nline", "d"},
+	})
+	tests := []struct {
+		header bool
+		comma  rune
+		want   string
+	}{
+		{true, ',', "keyword,context\n" +
+			`"a,b",plain` + "\n" +
+			`x,"say ""hi"""` + "\n" +
+			"semi;colon,c\n" +
+			"\"new\nline\",d\n"},
+		{false, ';', "a,b;plain\n" +
+			`x;"say ""hi"""` + "\n" +
+			`"semi;colon";c` + "\n" +
+			"\"new\nline\";d\n"},
+	}
+	for _, test := range tests {
+		got := render(t, func(w io.Writer) (int64, error) {
+			return OutputCSV(w, lines, test.header, test.comma)
+		})
+		if got != test.want {
+			t.Errorf("header %v, comma %q: wrote %q, want %q", test.header, test.comma, got, test.want)
+		}
+	}
+}
+
+func TestOutputHashed(t *testing.T) {
+	lines := StorageFromLines([][]string{{"a", "b"}, {"a", "c"}, {"a", "b"}, {"ab"}})
+	got := strings.Split(strings.TrimSuffix(render(t, func(w io.Writer) (int64, error) {
+		return OutputHashed(w, lines)
+	}), "\n"), "\n")
+	if len(got) != lines.Lines() {
+		t.Fatalf("wrote %d lines, want %d", len(got), lines.Lines())
+	}
+	hashes := map[string]string{}
+	for line, entry := range got {
+		hash, text, ok := strings.Cut(entry, "\t")
+		sum := sha256.Sum256([]byte(RenderLine(lines, line+1)))
+		if !ok || text != RenderLine(lines, line+1) || hash != hex.EncodeToString(sum[:4]) {
+			t.Errorf("line %d is %q, want the first 8 hex digits of the SHA-256 of %q, a tab, and the text",
+				line+1, entry, RenderLine(lines, line+1))
+		}
+		if earlier, ok := hashes[hash]; ok && earlier != text {
+			t.Errorf("%q and %q have the same hash %s", earlier, text, hash)
+		}
+		hashes[hash] = text
+	}
+	if len(hashes) != 3 {
+		t.Errorf("%d distinct hashes for 3 distinct lines", len(hashes))
+	}
+}
+
+func TestOutputRTL(t *testing.T) {
+	lines := StorageFromLines([][]string{{"שלום", "עולם", "טוב"}, {"one"}})
+	got := render(t, func(w io.Writer) (int64, error) {
+		return OutputRTL(w, lines)
+	})
+	if want := "\u200fטוב עולם שלום\n\u200fone\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+	// The keyword is still the same word after reversal.
+	reversed := &reversedHolder{NewReverseCircularShifter(lines)}
+	for line := 1; line <= reversed.Lines(); line++ {
+		if got, want := string(WordBytes(reversed, line, KeywordOf(reversed, line))), string(WordBytes(reversed.storage, line, KeywordOf(reversed.storage, line))); got != want {
+			t.Errorf("line %d: keyword %q after reversal, want %q", line, got, want)
+		}
+	}
+}
+
+func TestOutputByteCount(t *testing.T) {
+	index := NewAlphabetizer(NewCircularShifter(storageOf(t, "the quick fox\ncafé crème\n\"quoted\", <tagged> & more\n")))
+	outputs := []struct {
+		name   string
+		output func(w io.Writer) (int64, error)
+	}{
+		{"text", func(w io.Writer) (int64, error) { return Output(w, index) }},
+		{"parallel", func(w io.Writer) (int64, error) { return OutputParallel(w, index, 2) }},
+		{"prefixed", func(w io.Writer) (int64, error) { return OutputPrefixed(w, index) }},
+		{"csv", func(w io.Writer) (int64, error) { return OutputCSV(w, index, true, ',') }},
+		{"csv split", func(w io.Writer) (int64, error) { return OutputCSVSplit(w, index, true, ';') }},
+		{"json", func(w io.Writer) (int64, error) { return OutputJSON(w, index) }},
+		{"html", func(w io.Writer) (int64, error) { return OutputHTML(w, index) }},
+		{"ptx", func(w io.Writer) (int64, error) { return OutputPtx(w, index) }},
+		{"rtl", func(w io.Writer) (int64, error) { return OutputRTL(w, index) }},
+		{"hashed", func(w io.Writer) (int64, error) { return OutputHashed(w, index) }},
+		{"keys", func(w io.Writer) (int64, error) { return OutputKeys(w, index) }},
+		{"indented", func(w io.Writer) (int64, error) { return OutputIndented(w, index, "\t") }},
+		{"aligned", func(w io.Writer) (int64, error) { return OutputAligned(w, index, 12) }},
+		{"numbered", func(w io.Writer) (int64, error) { return OutputNumbered(w, index) }},
+		{"numbered after", func(w io.Writer) (int64, error) { return OutputNumberedAfter(w, index) }},
+		{"counted", func(w io.Writer) (int64, error) { return OutputCounted(w, index) }},
+		{"partial", func(w io.Writer) (int64, error) { return OutputPartial(w, index) }},
+		{"inverted", func(w io.Writer) (int64, error) { return OutputInverted(w, InvertedIndex(index)) }},
+	}
+	for _, test := range outputs {
+		var out bytes.Buffer
+		n, err := test.output(&out)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if out.Len() == 0 {
+			t.Errorf("%s: wrote nothing", test.name)
+		}
+		if n != int64(out.Len()) {
+			t.Errorf("%s: reported writing %d bytes, but wrote %d", test.name, n, out.Len())
+		}
+	}
+}
+
+func TestOutputKeys(t *testing.T) {
+	index := NewAlphabetizer(NewCircularShifter(storageOf(t, "Éclair café\napple Apple\n")))
+	tests := []struct {
+		name        string
+		lines       LineHolder
+		left, right string
+	}{
+		{"unmarked", index, "", ""},
+		{"marked", NewMarkedHolder(index, "[", "]"), "[", "]"},
+		{"marked twice", NewMarkedHolder(NewMarkedHolder(index, "<", ">"), "\x1b[1m", "\x1b[0m"), "\x1b[1m<", ">\x1b[0m"},
+	}
+	for _, test := range tests {
+		got := render(t, func(w io.Writer) (int64, error) { return OutputKeys(w, test.lines) })
+		printed := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+		if len(printed) != index.Lines() {
+			t.Fatalf("%s: wrote %d lines, want %d:\n%s", test.name, len(printed), index.Lines(), got)
+		}
+		for line, text := range printed {
+			key, rest, ok := strings.Cut(text, "\t")
+			if !ok {
+				t.Fatalf("%s: line %q has no tab after its key", test.name, text)
+			}
+			// The key is of the keyword alone, whatever marks it.
+			var want []string
+			keyword := []rune(string(WordBytes(index, line+1, KeywordOf(index, line+1))))
+			for _, char := range keyword {
+				want = append(want, strconv.FormatUint(NormalizeChar(char), 16))
+			}
+			if key != strings.Join(want, ".") {
+				t.Errorf("%s: line %q has key %s, want %s for %q", test.name, text, key, strings.Join(want, "."), string(keyword))
+			}
+			if !strings.HasPrefix(rest, test.left+string(keyword)+test.right) {
+				t.Errorf("%s: line %q doesn't begin with its marked keyword", test.name, rest)
+			}
+		}
+	}
+}
+
+func TestCacheHolder(t *testing.T) {
+	for _, shifts := range []LineHolder{
+		NewCircularShifter(corpus(200)),
+		NewReverseCircularShifter(storageOf(t, "a bb ccc\n\nxyz\n")),
+	} {
+		index := NewAlphabetizer(shifts)
+		cached := NewCacheHolder(index)
+		if fmt.Sprint(wordsOf(cached)) != fmt.Sprint(wordsOf(index)) {
+			t.Errorf("cached lines %q, want %q", wordsOf(cached), wordsOf(index))
+		}
+		for line := 1; line <= index.Lines(); line++ {
+			if KeywordOf(cached, line) != KeywordOf(index, line) || OriginalLineOf(cached, line) != OriginalLineOf(index, line) {
+				t.Errorf("line %d: cached keyword %d and original %d, want %d and %d", line,
+					KeywordOf(cached, line), OriginalLineOf(cached, line), KeywordOf(index, line), OriginalLineOf(index, line))
+			}
+		}
+		for width := 0; width <= 20; width += 10 {
+			got := render(t, func(w io.Writer) (int64, error) { return OutputAligned(w, cached, width) })
+			want := render(t, func(w io.Writer) (int64, error) { return OutputAligned(w, index, width) })
+			if got != want {
+				t.Errorf("aligned to %d, cached output is\n%s\nwant\n%s", width, got, want)
+			}
+		}
+	}
+}
+
+// benchmarkOutputCache is like benchmarkOutput, timing NewCacheHolder as well
+// if cache.
+func benchmarkOutputCache(b *testing.B, cache bool, output func(w io.Writer, lines LineHolder) (int64, error)) {
+	index := NewAlphabetizer(NewCircularShifter(corpus(50000)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lines := index
+		if cache {
+			lines = NewCacheHolder(index)
+		}
+		n, err := output(io.Discard, lines)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(n)
+	}
+}
+
+func outputAligned(w io.Writer, lines LineHolder) (int64, error) {
+	return OutputAligned(w, lines, 40)
+}
+
+func BenchmarkOutputCached(b *testing.B) {
+	benchmarkOutputCache(b, true, Output)
+}
+
+func BenchmarkOutputAligned(b *testing.B) {
+	benchmarkOutputCache(b, false, outputAligned)
+}
+
+func BenchmarkOutputAlignedCached(b *testing.B) {
+	benchmarkOutputCache(b, true, outputAligned)
+}
+
+func TestUnmarked(t *testing.T) {
+	lines := StorageFromLines([][]string{{"a", "b"}})
+	if unmarked(lines) != LineHolder(lines) {
+		t.Errorf("unmarked changed lines that have no markers")
+	}
+	marked := NewMarkedHolder(NewMarkedHolder(lines, "[", "]"), "\x1b[1m", "\x1b[0m")
+	if got := RenderLine(marked, 1); got != "\x1b[1m[a]\x1b[0m b" {
+		t.Errorf("marked line is %q", got)
+	}
+	if unmarked(marked) != LineHolder(lines) {
+		t.Errorf("unmarked didn't remove every marker")
+	}
+}
+
+func TestOutputJSON(t *testing.T) {
+	storage := storageOf(t, "the \"quick\" fox\n\ncafé\n")
+	// A holder that only has the LineHolder methods doesn't know its input lines.
+	type bareHolder struct{ LineHolder }
+	holders := []struct {
+		name  string
+		lines LineHolder
+	}{
+		{"forward", NewAlphabetizer(NewCircularShifter(storage))},
+		{"reversed", NewAlphabetizer(NewReverseCircularShifter(storage))},
+		{"no source", bareHolder{StorageFromLines([][]string{{"a", "b"}})}},
+		{"empty", &LineStorage{}},
+	}
+	for _, test := range holders {
+		got := render(t, func(w io.Writer) (int64, error) { return OutputJSON(w, test.lines) })
+		var records []map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(got), &records); err != nil {
+			t.Fatalf("%s: output isn't a JSON array: %v\n%s", test.name, err, got)
+		}
+		if len(records) != test.lines.Lines() {
+			t.Fatalf("%s: %d records for %d lines", test.name, len(records), test.lines.Lines())
+		}
+		for i, record := range records {
+			line := i + 1
+			var entry struct {
+				Keyword     string   `json:"keyword"`
+				Words       []string `json:"words"`
+				ShiftedText string   `json:"shiftedText"`
+				SourceLine  int      `json:"sourceLine"`
+				StartWord   int      `json:"startWord"`
+			}
+			for _, field := range []string{"keyword", "words", "shiftedText", "sourceLine", "startWord"} {
+				if _, ok := record[field]; !ok {
+					t.Errorf("%s: record %d has no %q field", test.name, line, field)
+				}
+			}
+			if len(record) != 5 {
+				t.Errorf("%s: record %d has %d fields, want 5", test.name, line, len(record))
+			}
+			raw, _ := json.Marshal(record)
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				t.Fatal(err)
+			}
+			want := OriginalLineOf(test.lines, line)
+			if entry.Keyword != string(WordBytes(test.lines, line, KeywordOf(test.lines, line))) ||
+				fmt.Sprint(entry.Words) != fmt.Sprint(wordsOf(test.lines)[i]) ||
+				entry.ShiftedText != RenderLine(test.lines, line) ||
+				entry.SourceLine != want ||
+				entry.StartWord != StartWordOf(test.lines, line) {
+				t.Errorf("%s: record %d is %+v for line %q from line %d starting at word %d", test.name, line,
+					entry, RenderLine(test.lines, line), want, StartWordOf(test.lines, line))
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package kwic
+
+// Module 1 (alternative): Packed Line Storage
+
+// PackedStorage holds lines of words in memory like LineStorage, but keeps the
+// characters of every word end to end in a single slice, with tables of where
+// each word and line begins. This avoids the overhead of a slice per word and
+// per line, which outweighs the characters themselves when words are short.
+// Build it with SetWord. Lines can't be edited once added.
+type PackedStorage struct {
+	chars []rune
+	words []int // words[i] is the index in chars of the first character of word i
+	lines []int // lines[i] is the index in words of the first word of line i
+	lineNumbers
+}
+
+func (packed *PackedStorage) Char(line, word, char int) rune {
+	return packed.chars[packed.words[packed.lines[line-1]+word-1]+char-1]
+}
+
+func (packed *PackedStorage) Lines() int {
+	return len(packed.lines)
+}
+
+func (packed *PackedStorage) Words(line int) int {
+	end := len(packed.words)
+	if line < len(packed.lines) {
+		end = packed.lines[line]
+	}
+	return end - packed.lines[line-1]
+}
+
+func (packed *PackedStorage) Chars(line, word int) int {
+	i := packed.lines[line-1] + word - 1
+	end := len(packed.chars)
+	if i+1 < len(packed.words) {
+		end = packed.words[i+1]
+	}
+	return end - packed.words[i]
+}
+
+// SetWord adds a character to the last word, a new word on the last line, or a
+// new word on a new line, as LineStorage.SetWord does.
+func (packed *PackedStorage) SetWord(line, word, char int, value rune) error {
+	newLine, newWord, err := checkSetWord(packed, line, word, char)
+	if err != nil {
+		return err
+	}
+	if newLine {
+		packed.lines = append(packed.lines, len(packed.words))
+		packed.add()
+	}
+	if newWord {
+		packed.words = append(packed.words, len(packed.chars))
+	}
+	packed.chars = append(packed.chars, value)
+	return nil
+}
@@ -0,0 +1,183 @@
+package kwic
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Orphans returns an alphabetized holder of the distinct words in storage that
+// are never the keyword of a line of shifted, one word per line.
+func Orphans(storage, shifted LineHolder) LineHolder {
+	keywords := make(map[string]bool)
+	for line := 1; line <= shifted.Lines(); line++ {
+		if shifted.Words(line) == 0 {
+			continue
+		}
+		keywords[string(WordBytes(shifted, line, KeywordOf(shifted, line)))] = true
+	}
+	orphaned := &LineStorage{}
+	for line := 1; line <= storage.Lines(); line++ {
+		for word := 1; word <= storage.Words(line); word++ {
+			chars := WordBytes(storage, line, word)
+			if keywords[string(chars)] {
+				continue
+			}
+			keywords[string(chars)] = true
+			orphaned.AppendLine(chars)
+		}
+	}
+	return NewAlphabetizer(orphaned)
+}
+
+// InvertedIndex maps each distinct word in storage to the increasing numbers of
+// the input lines containing it.
+func InvertedIndex(storage LineHolder) map[string][]int {
+	index := make(map[string][]int)
+	for line := 1; line <= storage.Lines(); line++ {
+		original := inputLineOf(storage, line)
+		for word := 1; word <= storage.Words(line); word++ {
+			key := string(WordBytes(storage, line, word))
+			postings := index[key]
+			if len(postings) == 0 || postings[len(postings)-1] != original {
+				index[key] = append(postings, original)
+			}
+		}
+	}
+	return index
+}
+
+// OutputInverted writes one line per word of index, alphabetized, in the form
+// "word: 3, 7, 12".
+func OutputInverted(w io.Writer, index map[string][]int) (int64, error) {
+	out := newOutputWriter(w)
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	words := &LineStorage{}
+	for _, key := range keys {
+		words.AppendLine([]byte(key))
+	}
+	alphabetized := NewAlphabetizer(words)
+	for line := 1; line <= alphabetized.Lines() && out.ok(); line++ {
+		key := WordBytes(alphabetized, line, 1)
+		out.Write(key)
+		for i, posting := range index[string(key)] {
+			if i == 0 {
+				fmt.Fprintf(out, ": %d", posting)
+			} else {
+				fmt.Fprintf(out, ", %d", posting)
+			}
+		}
+		out.Write([]byte{'\n'})
+	}
+	return out.finish()
+}
+
+// DumpState writes the contents of storage, the shifts of shifted, and the
+// permutation of alphabetized in a human-readable form, for debugging. The
+// shifts and permutation are omitted unless shifted came from
+// NewCircularShifter and alphabetized from NewAlphabetizer. If alphabetized
+// sorts a filter of shifted, such as NewKeywordFilter, the permutation still
+// lists the numbers of shifts of shifted.
+func DumpState(w io.Writer, storage, shifted, alphabetized LineHolder) {
+	fmt.Fprintf(w, "storage: %d lines\n", storage.Lines())
+	for line := 1; line <= storage.Lines(); line++ {
+		fmt.Fprintf(w, "%d: ", line)
+		writeLine(w, storage, line)
+		w.Write([]byte{'\n'})
+	}
+	if shifter, ok := shifted.(*circularShifter); ok {
+		fmt.Fprintf(w, "shifts: %d (line, startWord)\n", len(shifter.shifts))
+		for i, shift := range shifter.shifts {
+			fmt.Fprintf(w, "%d: %d, %d\n", i+1, shift.line, shift.startWord)
+		}
+	}
+	if alpha, ok := alphabetized.(*alphabetizer); ok {
+		fmt.Fprintf(w, "perm: %d\n", len(alpha.perm))
+		for i, line := range alpha.perm {
+			// Look through filters to the line of shifted beneath.
+			for lines := alpha.storage; lines != shifted; {
+				filter, ok := lines.(*lineFilter)
+				if !ok {
+					break
+				}
+				line, lines = filter.kept[line-1], filter.storage
+			}
+			fmt.Fprintf(w, "%d: %d\n", i+1, line)
+		}
+	}
+}
+
+// LineExtremes holds the numbers of the lines with the most and fewest words and
+// characters, as numbered by the LineHolder they were found in, not the input.
+// Ties go to the earliest line.
+type LineExtremes struct {
+	MostWords, FewestWords int
+	MostChars, FewestChars int
+}
+
+// FindLineExtremes scans lines for its longest and shortest lines.
+func FindLineExtremes(lines LineHolder) LineExtremes {
+	var extremes LineExtremes
+	if lines.Lines() == 0 {
+		return extremes
+	}
+	extremes = LineExtremes{1, 1, 1, 1}
+	mostChars, fewestChars := LineChars(lines, 1), LineChars(lines, 1)
+	for line := 2; line <= lines.Lines(); line++ {
+		if lines.Words(line) > lines.Words(extremes.MostWords) {
+			extremes.MostWords = line
+		}
+		if lines.Words(line) < lines.Words(extremes.FewestWords) {
+			extremes.FewestWords = line
+		}
+		chars := LineChars(lines, line)
+		if chars > mostChars {
+			extremes.MostChars, mostChars = line, chars
+		}
+		if chars < fewestChars {
+			extremes.FewestChars, fewestChars = line, chars
+		}
+	}
+	return extremes
+}
+
+// Stats summarizes what a circular shifter indexed.
+type Stats struct {
+	Lines      int // lines given to the shifter
+	Words      int // words in those lines, each of which could begin a shift
+	Shifts     int // shifts presented
+	Suppressed int // shifts left out, as noise, short, or duplicates
+}
+
+// CountStats summarizes the shifts of shifted, which must have been made from
+// storage.
+func CountStats(storage, shifted LineHolder) Stats {
+	stats := Stats{Lines: storage.Lines(), Shifts: shifted.Lines()}
+	for line := 1; line <= storage.Lines(); line++ {
+		stats.Words += storage.Words(line)
+	}
+	stats.Suppressed = stats.Words - stats.Shifts
+	return stats
+}
+
+// PrintStats writes a summary of the input lines to w. Lines are identified by
+// their numbers in the input.
+func PrintStats(w io.Writer, storage LineHolder) {
+	fmt.Fprintf(w, "lines: %d\n", storage.Lines())
+	if storage.Lines() == 0 {
+		return
+	}
+	extremes := FindLineExtremes(storage)
+	fmt.Fprintf(w, "most words: line %d (%d words)\n",
+		inputLineOf(storage, extremes.MostWords), storage.Words(extremes.MostWords))
+	fmt.Fprintf(w, "fewest words: line %d (%d words)\n",
+		inputLineOf(storage, extremes.FewestWords), storage.Words(extremes.FewestWords))
+	fmt.Fprintf(w, "most characters: line %d (%d characters)\n",
+		inputLineOf(storage, extremes.MostChars), LineChars(storage, extremes.MostChars))
+	fmt.Fprintf(w, "fewest characters: line %d (%d characters)\n",
+		inputLineOf(storage, extremes.FewestChars), LineChars(storage, extremes.FewestChars))
+}
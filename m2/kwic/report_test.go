@@ -0,0 +1,140 @@
+package kwic
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestOrphans(t *testing.T) {
+	storage := &LineStorage{}
+	storage.AppendLine([]byte("the"), []byte("cat"), []byte("sat"))
+	storage.AppendLine([]byte("the"), []byte("end"))
+	tests := []struct {
+		name    string
+		shifted LineHolder
+		want    []string
+	}{
+		{"all shifts", NewCircularShifter(storage), nil},
+		{"noise", NewCircularShifterWithNoise(storage, EnglishNoiseWords()), []string{"the"}},
+		{"noise file", NewCircularShifterWithNoise(storage, map[string]bool{"THE": true, "Sat": true}), []string{"sat", "the"}},
+		{"short keywords", NewCircularShifterWith(storage, ShiftOptions{MinKeyword: 4}), []string{"cat", "end", "sat", "the"}},
+		{"only", NewCircularShifterWith(storage, ShiftOptions{Only: map[string]bool{"cat": true}}), []string{"end", "sat", "the"}},
+		{"reverse", NewReverseCircularShifter(storage), nil},
+		{"no words", &LineStorage{array: [][][]rune{{}, {[]rune("sat")}}}, []string{"cat", "end", "the"}},
+	}
+	for _, test := range tests {
+		orphans := Orphans(storage, test.shifted)
+		got := []string{}
+		for line := 1; line <= orphans.Lines(); line++ {
+			got = append(got, RenderLine(orphans, line))
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: orphans are %q, want %q", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: orphans are %q, want %q", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFindLineExtremes(t *testing.T) {
+	tests := []struct {
+		text string
+		want LineExtremes
+	}{
+		{"", LineExtremes{}},
+		{"one\n", LineExtremes{1, 1, 1, 1}},
+		{"a b c\nx\nlonger words here\nab\n", LineExtremes{1, 2, 3, 2}},
+		{"ab\ncd\nab cd\n", LineExtremes{3, 1, 3, 1}},
+	}
+	for _, test := range tests {
+		if got := FindLineExtremes(storageOf(t, test.text)); got != test.want {
+			t.Errorf("FindLineExtremes(%q) = %+v, want %+v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestPrintStats(t *testing.T) {
+	var out strings.Builder
+	PrintStats(&out, storageOf(t, "a b c\n\nx\nlonger words here\nab\n"))
+	want := "lines: 4\n" +
+		"most words: line 1 (3 words)\n" +
+		"fewest words: line 3 (1 words)\n" +
+		"most characters: line 4 (15 characters)\n" +
+		"fewest characters: line 3 (1 characters)\n"
+	if out.String() != want {
+		t.Errorf("PrintStats wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestInvertedIndex(t *testing.T) {
+	storage := storageOf(t, "the cat sat\nthe the end\n\ncat\nThe\n")
+	index := InvertedIndex(storage)
+	want := map[string][]int{
+		"the": {1, 2},
+		"cat": {1, 4},
+		"sat": {1},
+		"end": {2},
+		"The": {5},
+	}
+	if len(index) != len(want) {
+		t.Errorf("index has %d words, want %d: %v", len(index), len(want), index)
+	}
+	for word, postings := range want {
+		if fmt.Sprint(index[word]) != fmt.Sprint(postings) {
+			t.Errorf("%q is on lines %v, want %v", word, index[word], postings)
+		}
+	}
+	got := render(t, func(w io.Writer) (int64, error) {
+		return OutputInverted(w, index)
+	})
+	if want := "cat: 1, 4\nend: 2\nsat: 1\nThe: 5\nthe: 1, 2\n"; got != want {
+		t.Errorf("OutputInverted wrote %q, want %q", got, want)
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	storage := storageOf(t, "b a\nc\n")
+	shifted := NewCircularShifter(storage)
+	var out strings.Builder
+	DumpState(&out, storage, shifted, NewAlphabetizer(shifted))
+	want := "storage: 2 lines\n1: b a\n2: c\n" +
+		"shifts: 3 (line, startWord)\n1: 1, 1\n2: 1, 2\n3: 2, 1\n" +
+		"perm: 3\n1: 2\n2: 1\n3: 3\n"
+	if out.String() != want {
+		t.Errorf("DumpState wrote\n%s\nwant\n%s", out.String(), want)
+	}
+	// The permutation of a filter's lines lists the shifts they came from.
+	storage = storageOf(t, "b a\nc b\n")
+	shifted = NewCircularShifter(storage)
+	tests := []struct {
+		name   string
+		sorted LineHolder
+		perm   string
+	}{
+		{"keyword", NewAlphabetizer(NewKeywordFilter(shifted, []rune("b"))), "perm: 2\n1: 1\n2: 4\n"},
+		{"contains", NewAlphabetizer(NewContainsFilter(shifted, []rune("c"))), "perm: 2\n1: 4\n2: 3\n"},
+		{"both", NewAlphabetizer(NewContainsFilter(NewKeywordFilter(shifted, []rune("b")), []rune("c"))), "perm: 1\n1: 4\n"},
+	}
+	for _, test := range tests {
+		out.Reset()
+		DumpState(&out, storage, shifted, test.sorted)
+		want := "storage: 2 lines\n1: b a\n2: c b\n" +
+			"shifts: 4 (line, startWord)\n1: 1, 1\n2: 1, 2\n3: 2, 1\n4: 2, 2\n" + test.perm
+		if out.String() != want {
+			t.Errorf("%s: DumpState wrote\n%s\nwant\n%s", test.name, out.String(), want)
+		}
+	}
+	// Other modules have no shifts or permutation to show.
+	out.Reset()
+	DumpState(&out, storage, NewLazyCircularShifter(storage), NewContainsFilter(NewAlphabetizer(shifted), []rune("c")))
+	if want := "storage: 2 lines\n1: b a\n2: c b\n"; out.String() != want {
+		t.Errorf("DumpState wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
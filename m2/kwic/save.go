@@ -0,0 +1,222 @@
+package kwic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Saved indexes
+
+// An index file begins with indexMagic and a version number, so that files from
+// other programs or other versions aren't misread. Every number after them is an
+// unsigned varint, as written by binary.PutUvarint.
+const (
+	indexMagic   = "KWIC index\n"
+	indexVersion = 1
+)
+
+// SavedIndex holds the modules of an index read by LoadIndex.
+type SavedIndex struct {
+	Storage LineHolder // the lines that were shifted, numbered as in the input
+	Shifts  LineHolder // their circular shifts
+	Sorted  LineHolder // the shifts in the order they were saved in
+}
+
+// SaveIndex writes index, an alphabetizer of a circular shifter, to the named
+// file as WriteIndex does, so that LoadIndex can read it back without building
+// it again.
+func SaveIndex(path string, index LineHolder) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = WriteIndex(file, index)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriteIndex writes index, an alphabetizer of a circular shifter, to w: the
+// lines it shifted along with their input line numbers, its shifts, and its
+// order. It returns an error for any other kind of LineHolder, such as a lazy
+// shifter or a filter of an alphabetizer, since those can't be read back the
+// same. The ordering function isn't recorded, only the order it produced, so
+// an index that will be searched with Lookup must be sorted by LinesLess.
+func WriteIndex(w io.Writer, index LineHolder) error {
+	sorted, ok := index.(*alphabetizer)
+	if !ok {
+		return errors.New("only alphabetized lines can be saved")
+	}
+	shifter, ok := sorted.storage.(*circularShifter)
+	if !ok {
+		return errors.New("only alphabetized circular shifts can be saved")
+	}
+	storage := shifter.storage
+	buffered := bufio.NewWriter(w)
+	buffered.WriteString(indexMagic)
+	var scratch [binary.MaxVarintLen64]byte
+	put := func(n int) {
+		buffered.Write(scratch[:binary.PutUvarint(scratch[:], uint64(n))])
+	}
+	put(indexVersion)
+	put(storage.Lines())
+	for line := 1; line <= storage.Lines(); line++ {
+		put(inputLineOf(storage, line))
+		put(storage.Words(line))
+		for word := 1; word <= storage.Words(line); word++ {
+			put(storage.Chars(line, word))
+			for char := 1; char <= storage.Chars(line, word); char++ {
+				put(int(storage.Char(line, word, char)))
+			}
+		}
+	}
+	reverse := 0
+	if shifter.reverse {
+		reverse = 1
+	}
+	put(reverse)
+	put(len(shifter.shifts))
+	for _, shift := range shifter.shifts {
+		put(shift.line)
+		put(shift.startWord)
+	}
+	put(len(sorted.perm))
+	for _, line := range sorted.perm {
+		put(line)
+	}
+	// bufio.Writer keeps the first error, so checking here is enough.
+	return buffered.Flush()
+}
+
+// LoadIndex reads an index from the named file as ReadIndex does.
+func LoadIndex(path string) (*SavedIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadIndex(file)
+}
+
+// ReadIndex reads an index written by WriteIndex from r. It returns an error if
+// r holds anything else, including an index from another version.
+func ReadIndex(r io.Reader) (*SavedIndex, error) {
+	reader := bufio.NewReader(r)
+	magic := make([]byte, len(indexMagic))
+	_, err := io.ReadFull(reader, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil && string(magic) != indexMagic {
+		return nil, errors.New("not a saved index")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// get reads a number no greater than max.
+	get := func(max int, what string) (int, error) {
+		n, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n > uint64(max) {
+			return 0, fmt.Errorf("saved index has bad %s %d", what, n)
+		}
+		return int(n), nil
+	}
+	version, err := get(math.MaxInt, "version")
+	if err != nil {
+		return nil, err
+	}
+	if version != indexVersion {
+		return nil, fmt.Errorf("saved index has version %d, not %d", version, indexVersion)
+	}
+	lines, err := get(math.MaxInt, "line count")
+	if err != nil {
+		return nil, err
+	}
+	storage := &LineStorage{}
+	// Counts are only trusted as far as the data behind them goes, so slices
+	// grow as they're read rather than being made at full size up front.
+	for line := 1; line <= lines; line++ {
+		original, err := get(math.MaxInt, "line number")
+		if err != nil {
+			return nil, err
+		}
+		storage.originals = append(storage.originals, original)
+		words, err := get(math.MaxInt, "word count")
+		if err != nil {
+			return nil, err
+		}
+		stored := [][]rune{}
+		for word := 1; word <= words; word++ {
+			chars, err := get(math.MaxInt, "character count")
+			if err != nil {
+				return nil, err
+			}
+			if chars == 0 {
+				return nil, errors.New("saved index has an empty word")
+			}
+			value := []rune{}
+			for char := 1; char <= chars; char++ {
+				code, err := get(0x10ffff, "character")
+				if err != nil {
+					return nil, err
+				}
+				value = append(value, rune(code))
+			}
+			stored = append(stored, value)
+		}
+		storage.array = append(storage.array, stored)
+	}
+	reverse, err := get(1, "shift direction")
+	if err != nil {
+		return nil, err
+	}
+	shifter := &circularShifter{storage: storage, reverse: reverse == 1}
+	count, err := get(math.MaxInt, "shift count")
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		line, err := get(lines, "shifted line")
+		if err != nil {
+			return nil, err
+		}
+		if line == 0 {
+			return nil, errors.New("saved index has bad shifted line 0")
+		}
+		startWord, err := get(storage.Words(line), "shift start word")
+		if err != nil {
+			return nil, err
+		}
+		if startWord == 0 {
+			return nil, errors.New("saved index has bad shift start word 0")
+		}
+		shifter.shifts = append(shifter.shifts, shift{line, startWord})
+	}
+	count, err = get(len(shifter.shifts), "sorted line count")
+	if err != nil {
+		return nil, err
+	}
+	sorted := &alphabetizer{storage: shifter}
+	seen := make([]bool, len(shifter.shifts))
+	for i := 0; i < count; i++ {
+		line, err := get(len(shifter.shifts), "sorted line")
+		if err != nil {
+			return nil, err
+		}
+		if line == 0 || seen[line-1] {
+			return nil, fmt.Errorf("saved index has bad sorted line %d", line)
+		}
+		seen[line-1] = true
+		sorted.perm = append(sorted.perm, line)
+	}
+	return &SavedIndex{storage, shifter, sorted}, nil
+}
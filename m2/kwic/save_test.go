@@ -0,0 +1,147 @@
+package kwic
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// savedBytes returns index as WriteIndex writes it.
+func savedBytes(t *testing.T, index LineHolder) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := WriteIndex(&out, index); err != nil {
+		t.Fatalf("WriteIndex: %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestSaveIndexRoundTrip(t *testing.T) {
+	storage := storageOf(t, "the quick fox\n\nha ha\n  café crème  \nthe quick fox\n")
+	tests := []struct {
+		name   string
+		shifts LineHolder
+	}{
+		{"forward", NewCircularShifter(storage)},
+		{"reverse", NewReverseCircularShifter(storage)},
+		{"unique", NewCircularShifterWith(storage, ShiftOptions{Unique: true})},
+		{"reverse unique", NewCircularShifterWith(storage, ShiftOptions{Reverse: true, Unique: true})},
+		{"noise", NewCircularShifterWithNoise(storage, EnglishNoiseWords())},
+	}
+	for _, test := range tests {
+		index := NewAlphabetizer(test.shifts)
+		saved, err := ReadIndex(bytes.NewReader(savedBytes(t, index)))
+		if err != nil {
+			t.Errorf("%s: ReadIndex: %v", test.name, err)
+			continue
+		}
+		pairs := []struct {
+			what      string
+			got, want LineHolder
+		}{
+			{"storage", saved.Storage, storage},
+			{"shifts", saved.Shifts, test.shifts},
+			{"index", saved.Sorted, index},
+		}
+		for _, pair := range pairs {
+			got := render(t, func(w io.Writer) (int64, error) { return OutputNumbered(w, pair.got) })
+			want := render(t, func(w io.Writer) (int64, error) { return OutputNumbered(w, pair.want) })
+			if got != want {
+				t.Errorf("%s: loaded %s\n%s\nwant\n%s", test.name, pair.what, got, want)
+			}
+			for line := 1; line <= pair.want.Lines() && line <= pair.got.Lines(); line++ {
+				if KeywordOf(pair.got, line) != KeywordOf(pair.want, line) {
+					t.Errorf("%s: line %d of loaded %s has keyword %d, want %d",
+						test.name, line, pair.what, KeywordOf(pair.got, line), KeywordOf(pair.want, line))
+				}
+			}
+		}
+	}
+	// SaveIndex and LoadIndex do the same through a file.
+	index := NewAlphabetizer(NewReverseCircularShifter(storage))
+	path := filepath.Join(t.TempDir(), "index.kwic")
+	if err := SaveIndex(path, index); err != nil {
+		t.Fatalf("SaveIndex: %v", err)
+	}
+	saved, err := LoadIndex(path)
+	if err != nil {
+		t.Fatalf("LoadIndex: %v", err)
+	}
+	got := render(t, func(w io.Writer) (int64, error) { return Output(w, saved.Sorted) })
+	if want := render(t, func(w io.Writer) (int64, error) { return Output(w, index) }); got != want {
+		t.Errorf("loaded index\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteIndexUnsupported(t *testing.T) {
+	storage := storageOf(t, "a b\n")
+	for _, index := range []LineHolder{
+		storage,
+		NewCircularShifter(storage),
+		NewAlphabetizer(NewLazyCircularShifter(storage)),
+		NewContainsFilter(NewAlphabetizer(NewCircularShifter(storage)), []rune("a")),
+	} {
+		if err := WriteIndex(io.Discard, index); err == nil {
+			t.Errorf("WriteIndex of %T succeeded", index)
+		}
+	}
+}
+
+func TestReadIndexCorrupt(t *testing.T) {
+	good := savedBytes(t, NewAlphabetizer(NewCircularShifter(storageOf(t, "the quick fox\nhello\n"))))
+	// Every truncation is an error.
+	for n := 0; n < len(good); n++ {
+		if _, err := ReadIndex(bytes.NewReader(good[:n])); err == nil {
+			t.Errorf("no error reading the first %d of %d bytes", n, len(good))
+		}
+	}
+	version := len(indexMagic)
+	tests := []struct {
+		name    string
+		change  func(saved []byte) []byte
+		wantErr string // a substring of the error
+	}{
+		{"bad magic", func(saved []byte) []byte { saved[0] = 'k'; return saved }, "not a saved index"},
+		{"other file", func([]byte) []byte { return []byte("the quick fox jumped over the lazy dog\n") }, "not a saved index"},
+		{"bad version", func(saved []byte) []byte { saved[version] = indexVersion + 1; return saved }, "version"},
+		{"zero shift line", func(saved []byte) []byte { return withShift(saved, 0, 1) }, "shifted line"},
+		{"shift line past last", func(saved []byte) []byte { return withShift(saved, 3, 1) }, "shifted line"},
+		{"zero start word", func(saved []byte) []byte { return withShift(saved, 1, 0) }, "start word"},
+		{"start word past last", func(saved []byte) []byte { return withShift(saved, 1, 4) }, "start word"},
+		{"repeated sorted line", func(saved []byte) []byte {
+			saved[len(saved)-1] = saved[len(saved)-2]
+			return saved
+		}, "sorted line"},
+		{"character out of range", func(saved []byte) []byte {
+			// Replace the "t" of "the" with a number past U+10FFFF.
+			i := bytes.IndexByte(saved[version:], 't') + version
+			return append(append(append([]byte{}, saved[:i]...), 0x80, 0x80, 0x44), saved[i+1:]...)
+		}, "character"},
+	}
+	for _, test := range tests {
+		saved := test.change(append([]byte{}, good...))
+		_, err := ReadIndex(bytes.NewReader(saved))
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error %v, want one containing %q", test.name, err, test.wantErr)
+		}
+	}
+	// Corrupting any byte may or may not be noticed, but mustn't panic.
+	for i := range good {
+		for _, value := range []byte{0, 1, 0x7f, 0x80, 0xff} {
+			corrupt := append([]byte{}, good...)
+			corrupt[i] = value
+			ReadIndex(bytes.NewReader(corrupt))
+		}
+	}
+}
+
+// withShift returns saved, an index of two lines of three and one words, with
+// its first shift replaced by one of the given line and start word.
+func withShift(saved []byte, line, startWord byte) []byte {
+	// The shifts follow the direction, 0, and their count, 4.
+	i := bytes.Index(saved, []byte{0, 4, 1, 1}) + 2
+	saved[i], saved[i+1] = line, startWord
+	return saved
+}
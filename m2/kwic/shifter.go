@@ -0,0 +1,289 @@
+package kwic
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Module 3: Circular Shifter
+
+type circularShifter struct {
+	storage LineHolder
+	shifts  []shift
+	reverse bool // keywords end shifts rather than beginning them
+}
+
+type shift struct {
+	line      int
+	startWord int // word of line that begins the shift
+}
+
+// storageWord returns which word of the shift's line is the given word of the
+// shift, where the line has words words. Words past the end wrap around to the
+// beginning as many times as needed.
+func (shift shift) storageWord(word, words int) int {
+	return (word+shift.startWord-2)%words + 1
+}
+
+// NewCircularShifter presents every circular shift of every line of storage:
+// for each word of a line, the line rotated to begin with that word.
+func NewCircularShifter(storage LineHolder) LineHolder {
+	return NewCircularShifterWithNoise(storage, nil)
+}
+
+// NewCircularShifterWithNoise is like NewCircularShifter but leaves out the
+// shifts that would begin with a noise word, compared case-insensitively. Noise
+// words still appear in the other shifts of their lines.
+func NewCircularShifterWithNoise(storage LineHolder, noise map[string]bool) LineHolder {
+	return NewCircularShifterWith(storage, ShiftOptions{Noise: noise})
+}
+
+// NewReverseCircularShifter is like NewCircularShifter but rotates each line to
+// end with each of its words instead, so the keyword of each shift is its last
+// word.
+func NewReverseCircularShifter(storage LineHolder) LineHolder {
+	return NewCircularShifterWith(storage, ShiftOptions{Reverse: true})
+}
+
+// ShiftOptions controls which circular shifts NewCircularShifterWith presents.
+type ShiftOptions struct {
+	Noise      map[string]bool // leave out shifts whose keywords are these words
+	Only       map[string]bool // if not empty, leave out shifts whose keywords aren't these words
+	MinKeyword int             // leave out shifts whose keywords have fewer characters
+	Unique     bool            // leave out shifts equal to earlier shifts
+	Reverse    bool            // end shifts with their keywords, as NewReverseCircularShifter
+}
+
+// NewCircularShifterWith is like NewCircularShifter but leaves out shifts as
+// directed by opts. Noise words and the words of opts.Only are compared
+// case-insensitively. Noise words, short words, and words not in opts.Only still
+// appear in the other shifts of their lines. Shifts are compared for
+// uniqueness with LinesEqual, so a repeated line or a line that repeats itself
+// (such as "ha ha") contributes each distinct shift only once.
+func NewCircularShifterWith(storage LineHolder, opts ShiftOptions) LineHolder {
+	noise := lowerWords(opts.Noise)
+	only := lowerWords(opts.Only)
+	shifter := &circularShifter{storage: storage, reverse: opts.Reverse}
+	for line := 1; line <= storage.Lines(); line++ {
+		words := storage.Words(line)
+		for word := 1; word <= words; word++ {
+			if storage.Chars(line, word) < opts.MinKeyword {
+				continue
+			}
+			if len(noise) > 0 || len(only) > 0 {
+				keyword := string(bytes.ToLower(WordBytes(storage, line, word)))
+				if noise[keyword] || len(only) > 0 && !only[keyword] {
+					continue
+				}
+			}
+			if opts.Reverse {
+				// Begin with the word after, so that word ends the shift.
+				shifter.shifts = append(shifter.shifts, shift{line, word%words + 1})
+			} else {
+				shifter.shifts = append(shifter.shifts, shift{line, word})
+			}
+		}
+	}
+	if opts.Unique {
+		// Only shifts with the same first word and number of words can be
+		// equal, so compare just those.
+		type bucket struct {
+			keyword string
+			words   int
+		}
+		buckets := map[bucket][]int{}
+		unique := []shift{}
+		for line := 1; line <= shifter.Lines(); line++ {
+			b := bucket{string(WordBytes(shifter, line, 1)), shifter.Words(line)}
+			duplicate := false
+			for _, earlier := range buckets[b] {
+				if LinesEqual(shifter, earlier, line) {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				buckets[b] = append(buckets[b], line)
+				unique = append(unique, shifter.shifts[line-1])
+			}
+		}
+		shifter.shifts = unique
+	}
+	return shifter
+}
+
+// lowerWords returns the words in a set in lowercase.
+func lowerWords(set map[string]bool) map[string]bool {
+	lowered := map[string]bool{}
+	for word, in := range set {
+		if in {
+			lowered[strings.ToLower(word)] = true
+		}
+	}
+	return lowered
+}
+
+// EnglishNoiseWords returns a set of common English words that make poor
+// keywords, for use with NewCircularShifterWithNoise.
+func EnglishNoiseWords() map[string]bool {
+	noise := map[string]bool{}
+	for _, word := range strings.Fields(`
+		a an and are as at be but by for from has have in into is it its
+		of on or that the their this to was were with`) {
+		noise[word] = true
+	}
+	return noise
+}
+
+func (shifter *circularShifter) Char(line, word, char int) rune {
+	shift := shifter.shifts[line-1]
+	word = shift.storageWord(word, shifter.storage.Words(shift.line))
+	return shifter.storage.Char(shift.line, word, char)
+}
+
+func (shifter *circularShifter) OriginalLine(line int) int {
+	return inputLineOf(shifter.storage, shifter.shifts[line-1].line)
+}
+
+func (shifter *circularShifter) StartWord(line int) int {
+	return shifter.shifts[line-1].startWord
+}
+
+func (shifter *circularShifter) Keyword(line int) int {
+	if shifter.reverse {
+		return shifter.Words(line)
+	}
+	return 1
+}
+
+func (shifter *circularShifter) Lines() int {
+	return len(shifter.shifts)
+}
+
+func (shifter *circularShifter) Words(line int) int {
+	shift := shifter.shifts[line-1]
+	return shifter.storage.Words(shift.line)
+}
+
+func (shifter *circularShifter) Chars(line, word int) int {
+	shift := shifter.shifts[line-1]
+	word = shift.storageWord(word, shifter.storage.Words(shift.line))
+	return shifter.storage.Chars(shift.line, word)
+}
+
+// lazyShifter presents the same shifts as circularShifter without storing them.
+// ends[i] is the number of shifts of lines 1 through i+1, so the shift
+// presented as a line is found by binary search.
+type lazyShifter struct {
+	storage LineHolder
+	ends    []int
+}
+
+// NewLazyCircularShifter is like NewCircularShifter but stores only a count per
+// line of storage, finding each shift when it's requested.
+func NewLazyCircularShifter(storage LineHolder) LineHolder {
+	shifter := &lazyShifter{storage: storage, ends: make([]int, storage.Lines())}
+	total := 0
+	for line := 1; line <= storage.Lines(); line++ {
+		total += storage.Words(line)
+		shifter.ends[line-1] = total
+	}
+	return shifter
+}
+
+// shift returns which line of storage and word of that line begin the given
+// line.
+func (shifter *lazyShifter) shift(line int) shift {
+	i := sort.SearchInts(shifter.ends, line)
+	startWord := line
+	if i > 0 {
+		startWord -= shifter.ends[i-1]
+	}
+	return shift{i + 1, startWord}
+}
+
+func (shifter *lazyShifter) Char(line, word, char int) rune {
+	shift := shifter.shift(line)
+	word = shift.storageWord(word, shifter.storage.Words(shift.line))
+	return shifter.storage.Char(shift.line, word, char)
+}
+
+func (shifter *lazyShifter) OriginalLine(line int) int {
+	return inputLineOf(shifter.storage, shifter.shift(line).line)
+}
+
+func (shifter *lazyShifter) StartWord(line int) int {
+	return shifter.shift(line).startWord
+}
+
+func (shifter *lazyShifter) Lines() int {
+	if len(shifter.ends) == 0 {
+		return 0
+	}
+	return shifter.ends[len(shifter.ends)-1]
+}
+
+func (shifter *lazyShifter) Words(line int) int {
+	return shifter.storage.Words(shifter.shift(line).line)
+}
+
+func (shifter *lazyShifter) Chars(line, word int) int {
+	shift := shifter.shift(line)
+	word = shift.storageWord(word, shifter.storage.Words(shift.line))
+	return shifter.storage.Chars(shift.line, word)
+}
+
+// materializedHolder holds a copy of the lines of another LineHolder, for which
+// it still answers which lines they came from.
+type materializedHolder struct {
+	copied *LineStorage
+	source LineHolder
+}
+
+// NewMaterializedHolder copies every line of lines, such as the shifts of a
+// circular shifter, into memory up front. Reading the copy doesn't go through
+// the modules lines is made of, so sorting it is faster, at the cost of storing
+// each shift's own words.
+func NewMaterializedHolder(lines LineHolder) LineHolder {
+	copied := &LineStorage{array: make([][][]rune, lines.Lines())}
+	for line := range copied.array {
+		copied.array[line] = make([][]rune, lines.Words(line+1))
+		for word := range copied.array[line] {
+			chars := make([]rune, lines.Chars(line+1, word+1))
+			for char := range chars {
+				chars[char] = lines.Char(line+1, word+1, char+1)
+			}
+			copied.array[line][word] = chars
+		}
+	}
+	return &materializedHolder{copied, lines}
+}
+
+func (materialized *materializedHolder) Char(line, word, char int) rune {
+	return materialized.copied.Char(line, word, char)
+}
+
+func (materialized *materializedHolder) Lines() int {
+	return materialized.copied.Lines()
+}
+
+func (materialized *materializedHolder) Words(line int) int {
+	return materialized.copied.Words(line)
+}
+
+func (materialized *materializedHolder) Chars(line, word int) int {
+	return materialized.copied.Chars(line, word)
+}
+
+func (materialized *materializedHolder) OriginalLine(line int) int {
+	return OriginalLineOf(materialized.source, line)
+}
+
+func (materialized *materializedHolder) StartWord(line int) int {
+	return StartWordOf(materialized.source, line)
+}
+
+func (materialized *materializedHolder) Keyword(line int) int {
+	return KeywordOf(materialized.source, line)
+}
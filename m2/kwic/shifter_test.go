@@ -0,0 +1,77 @@
+package kwic
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestShiftStorageWord(t *testing.T) {
+	tests := []struct {
+		startWord, word, words int
+		want                   int
+	}{
+		{1, 1, 1, 1},
+		{1, 5, 5, 5},
+		{5, 1, 5, 5},
+		{5, 2, 5, 1},
+		{5, 5, 5, 4},
+		{3, 9, 5, 1},
+		{5, 11, 5, 5},
+		{5, 12, 5, 1},
+		{2, 31, 3, 2},
+	}
+	for _, test := range tests {
+		if got := (shift{1, test.startWord}).storageWord(test.word, test.words); got != test.want {
+			t.Errorf("word %d of a shift starting at word %d of %d is word %d, want %d",
+				test.word, test.startWord, test.words, got, test.want)
+		}
+	}
+}
+
+func TestCircularShifterWrapAround(t *testing.T) {
+	// A line much longer than the others, repeating words, so that misplaced
+	// wrap-around reads the wrong word rather than panicking.
+	long := strings.Fields("the cat and the dog and the bird and the fish and the end of a much longer line")
+	storage := StorageFromLines([][]string{{"short", "line"}, long, {"x"}})
+	for _, reverse := range []bool{false, true} {
+		shifts := NewCircularShifterWith(storage, ShiftOptions{Reverse: reverse})
+		shifted, lazy := wordsOf(shifts), wordsOf(NewLazyCircularShifter(storage))
+		line := 0
+		for _, words := range wordsOf(storage) {
+			for keyword := 1; keyword <= len(words); keyword++ {
+				line++
+				startWord := keyword
+				if reverse {
+					startWord = keyword%len(words) + 1
+				}
+				want := append(append([]string{}, words[startWord-1:]...), words[:startWord-1]...)
+				if got := shifted[line-1]; fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("reverse %v: shift %d is %q, want %q", reverse, line, got, want)
+				}
+				for word := 1; word <= len(want); word++ {
+					if chars := shifts.Chars(line, word); chars != len(want[word-1]) {
+						t.Errorf("reverse %v: word %d of shift %d has %d characters, want %d",
+							reverse, word, line, chars, len(want[word-1]))
+					}
+				}
+				if !reverse && fmt.Sprint(lazy[line-1]) != fmt.Sprint(want) {
+					t.Errorf("lazy shift %d is %q, want %q", line, lazy[line-1], want)
+				}
+			}
+		}
+		if line != shifts.Lines() {
+			t.Errorf("reverse %v: %d shifts, want %d", reverse, shifts.Lines(), line)
+		}
+	}
+	// The last rotation of the long line begins with its last word and reads
+	// across the wrap to the first.
+	shifts := NewCircularShifter(storage)
+	last := 2 + len(long)
+	if got, want := RenderLine(shifts, last), "line the cat and"; !strings.HasPrefix(got, want) {
+		t.Errorf("last rotation is %q, want it to begin %q", got, want)
+	}
+	if got, want := string(WordBytes(shifts, last, len(long))), "longer"; got != want {
+		t.Errorf("last word of the last rotation is %q, want %q", got, want)
+	}
+}
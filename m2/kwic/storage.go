@@ -0,0 +1,331 @@
+package kwic
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Module 1: Line Storage
+
+// Errors from LineStorage methods wrap one of these, according to whether a line
+// number, word number, or character number was wrong.
+var (
+	ErrBadLine = errors.New("bad line")
+	ErrBadWord = errors.New("bad word")
+	ErrBadChar = errors.New("bad character")
+)
+
+// LineStorage holds lines of words in memory. Build it with SetWord, and edit it
+// with ReplaceWord, DeleteWord, and DeleteLine. The modules that present its
+// lines in other ways, such as circular shifters, remember where its words were
+// when they were made, so they must be made again after storage is edited.
+type LineStorage struct {
+	array [][][]rune
+	lineNumbers
+}
+
+// lineNumbers remembers which line of the input each line of storage came from,
+// for storage that skips input lines without words.
+type lineNumbers struct {
+	originals []int // originals[line-1] is the input line that line came from
+	skipped   int   // input lines skipped since the last line was added
+}
+
+// add numbers a new line, just after the last line and any lines skipped since.
+func (numbers *lineNumbers) add() {
+	original := numbers.skipped + 1
+	if n := len(numbers.originals); n > 0 {
+		original += numbers.originals[n-1]
+	}
+	numbers.originals = append(numbers.originals, original)
+	numbers.skipped = 0
+}
+
+// SkipLines records that n lines of input without any words come before the
+// next line to be added, so that it's numbered after them.
+func (numbers *lineNumbers) SkipLines(n int) {
+	numbers.skipped += n
+}
+
+// OriginalLine returns the number of the input line that a line came from,
+// counting any lines skipped with SkipLines.
+func (numbers *lineNumbers) OriginalLine(line int) int {
+	return numbers.originals[line-1]
+}
+
+func (storage *LineStorage) Char(line, word, char int) rune {
+	return storage.array[line-1][word-1][char-1]
+}
+
+func (storage *LineStorage) Lines() int {
+	return len(storage.array)
+}
+
+func (storage *LineStorage) Words(line int) int {
+	return len(storage.array[line-1])
+}
+
+func (storage *LineStorage) Chars(line, word int) int {
+	return len(storage.array[line-1][word-1])
+}
+
+// SetWord adds a character to the last word, a new word on the last line, or a
+// new word on a new line. It returns an error, leaving storage unchanged, if the
+// character would go anywhere else.
+func (storage *LineStorage) SetWord(line, word, char int, value rune) error {
+	newLine, newWord, err := checkSetWord(storage, line, word, char)
+	if err != nil {
+		return err
+	}
+	if newLine {
+		storage.array = append(storage.array, nil)
+		storage.add()
+	}
+	if newWord {
+		storage.array[line-1] = append(storage.array[line-1], nil)
+	}
+	storage.array[line-1][word-1] = append(storage.array[line-1][word-1], value)
+	return nil
+}
+
+// checkSetWord returns an error if SetWord mustn't add a character to storage at
+// line, word, and char. Otherwise, it reports whether the character begins a new
+// line and whether it begins a new word.
+func checkSetWord(storage LineHolder, line, word, char int) (newLine, newWord bool, err error) {
+	lines := storage.Lines()
+	if line < lines || line > lines+1 {
+		return false, false, fmt.Errorf("%w: line %d is not the last line (%d) or just past it", ErrBadLine, line, lines)
+	}
+	words := 0
+	if line == lines {
+		words = storage.Words(line)
+	}
+	if word < words || word > words+1 {
+		return false, false, fmt.Errorf("%w: word %d of line %d is not the last word (%d) or just past it", ErrBadWord, word, line, words)
+	}
+	chars := 0
+	if line == lines && word == words {
+		chars = storage.Chars(line, word)
+	}
+	if char != chars+1 {
+		return false, false, fmt.Errorf("%w: character %d of word %d of line %d is not just past the last character (%d)", ErrBadChar, char, word, line, chars)
+	}
+	return line == lines+1, word == words+1, nil
+}
+
+// LineBuilder is a LineHolder that lines can be added to with SetWord, as input
+// functions do. LineStorage, PackedStorage, and SyncStorage are LineBuilders.
+// Each line is numbered by the line of input it came from, which input
+// functions tell it about by skipping input lines that have no words.
+type LineBuilder interface {
+	OriginalHolder
+	// SetWord adds a character to the last word, a new word on the last
+	// line, or a new word on a new line. It returns an error, leaving the
+	// lines unchanged, if the character would go anywhere else.
+	SetWord(line, word, char int, value rune) error
+	// SkipLines records that n lines of input without any words come
+	// before the next line to be added, so that it's numbered after them.
+	SkipLines(n int)
+}
+
+// AppendLine adds a new line made of the given words, which are decoded from
+// UTF-8. Empty words are skipped.
+func (storage *LineStorage) AppendLine(words ...[]byte) {
+	line, word := storage.Lines()+1, 1
+	for _, chars := range words {
+		if len(chars) == 0 {
+			continue
+		}
+		for char, value := range []rune(string(chars)) {
+			// This can't fail: each character goes just past the last.
+			storage.SetWord(line, word, char+1, value)
+		}
+		word++
+	}
+}
+
+// StorageFromString returns storage holding the lines of s, read as InputFrom
+// reads them with the default options.
+func StorageFromString(s string) *LineStorage {
+	storage := &LineStorage{}
+	// Reading from a string can't fail.
+	InputFrom(strings.NewReader(s), storage, InputOptions{})
+	return storage
+}
+
+// StorageFromLines returns storage holding the given lines of words. As with
+// AppendLine, empty words are skipped, and as with InputFrom, so are lines with
+// no words, though lines are still numbered by their places in lines.
+func StorageFromLines(lines [][]string) *LineStorage {
+	storage := &LineStorage{}
+	for _, line := range lines {
+		words := [][]byte{}
+		for _, word := range line {
+			if word != "" {
+				words = append(words, []byte(word))
+			}
+		}
+		if len(words) > 0 {
+			storage.AppendLine(words...)
+		} else {
+			storage.SkipLines(1)
+		}
+	}
+	return storage
+}
+
+// ReplaceWord replaces a word of a line with chars, which are decoded from
+// UTF-8. It returns an error if there's no such word or chars is empty.
+func (storage *LineStorage) ReplaceWord(line, word int, chars []byte) error {
+	if line < 1 || line > storage.Lines() {
+		return fmt.Errorf("%w: line %d is out of range (%d lines)", ErrBadLine, line, storage.Lines())
+	}
+	words := storage.array[line-1]
+	if word < 1 || word > len(words) {
+		return fmt.Errorf("%w: word %d of line %d is out of range (%d words)", ErrBadWord, word, line, len(words))
+	}
+	if len(chars) == 0 {
+		return fmt.Errorf("%w: word %d of line %d can't be replaced with an empty word", ErrBadWord, word, line)
+	}
+	words[word-1] = []rune(string(chars))
+	return nil
+}
+
+// DeleteLine removes a line, renumbering the lines after it. They still report
+// the input lines they came from as their original lines. It returns an error
+// if there's no such line.
+func (storage *LineStorage) DeleteLine(line int) error {
+	if line < 1 || line > storage.Lines() {
+		return fmt.Errorf("%w: line %d is out of range (%d lines)", ErrBadLine, line, storage.Lines())
+	}
+	storage.array = append(storage.array[:line-1], storage.array[line:]...)
+	storage.originals = append(storage.originals[:line-1], storage.originals[line:]...)
+	return nil
+}
+
+// DeleteWord removes a word from a line, renumbering the words after it.
+// Deleting the only word of a line leaves the line empty. It returns an error if
+// there's no such word.
+func (storage *LineStorage) DeleteWord(line, word int) error {
+	if line < 1 || line > storage.Lines() {
+		return fmt.Errorf("%w: line %d is out of range (%d lines)", ErrBadLine, line, storage.Lines())
+	}
+	words := storage.array[line-1]
+	if word < 1 || word > len(words) {
+		return fmt.Errorf("%w: word %d of line %d is out of range (%d words)", ErrBadWord, word, line, len(words))
+	}
+	storage.array[line-1] = append(words[:word-1], words[word:]...)
+	return nil
+}
+
+// SyncStorage is line storage that many goroutines can use at once, such as a
+// server's readers while a writer adds lines. Each method is atomic, but lines
+// can change between calls, so a reader that makes several calls, as the other
+// modules do, should read a Snapshot instead.
+type SyncStorage struct {
+	mu      sync.RWMutex
+	storage LineStorage
+}
+
+func (storage *SyncStorage) Char(line, word, char int) rune {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return storage.storage.Char(line, word, char)
+}
+
+func (storage *SyncStorage) Lines() int {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return storage.storage.Lines()
+}
+
+func (storage *SyncStorage) Words(line int) int {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return storage.storage.Words(line)
+}
+
+func (storage *SyncStorage) Chars(line, word int) int {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return storage.storage.Chars(line, word)
+}
+
+func (storage *SyncStorage) OriginalLine(line int) int {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	return storage.storage.OriginalLine(line)
+}
+
+// SetWord is like LineStorage.SetWord.
+func (storage *SyncStorage) SetWord(line, word, char int, value rune) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return storage.storage.SetWord(line, word, char, value)
+}
+
+// SkipLines is like LineStorage.SkipLines.
+func (storage *SyncStorage) SkipLines(n int) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.storage.SkipLines(n)
+}
+
+// AppendLine is like LineStorage.AppendLine, but readers never see part of the
+// line.
+func (storage *SyncStorage) AppendLine(words ...[]byte) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.storage.AppendLine(words...)
+}
+
+// ReplaceWord is like LineStorage.ReplaceWord.
+func (storage *SyncStorage) ReplaceWord(line, word int, chars []byte) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.copyLine(line)
+	return storage.storage.ReplaceWord(line, word, chars)
+}
+
+// DeleteLine is like LineStorage.DeleteLine.
+func (storage *SyncStorage) DeleteLine(line int) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return storage.storage.DeleteLine(line)
+}
+
+// DeleteWord is like LineStorage.DeleteWord.
+func (storage *SyncStorage) DeleteWord(line, word int) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.copyLine(line)
+	return storage.storage.DeleteWord(line, word)
+}
+
+// copyLine gives line its own list of words before it's edited in place, since
+// snapshots may share the old one. It does nothing if there's no such line.
+func (storage *SyncStorage) copyLine(line int) {
+	if line >= 1 && line <= storage.storage.Lines() {
+		words := storage.storage.array[line-1]
+		storage.storage.array[line-1] = append([][]rune(nil), words...)
+	}
+}
+
+// Snapshot returns storage holding the lines of storage as they are now, which
+// later changes don't affect, so that it can be shifted, alphabetized, and read
+// while more lines are added. Taking one copies the list of lines, but not their
+// words, which stay shared until edited.
+func (storage *SyncStorage) Snapshot() *LineStorage {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	array := append([][][]rune(nil), storage.storage.array...)
+	if n := len(array); n > 0 {
+		// SetWord may yet add words to the last line.
+		array[n-1] = append([][]rune(nil), array[n-1]...)
+	}
+	numbers := storage.storage.lineNumbers
+	numbers.originals = append([]int(nil), numbers.originals...)
+	return &LineStorage{array, numbers}
+}
@@ -0,0 +1,195 @@
+package kwic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// wordsOf returns the words of each line of lines.
+func wordsOf(lines LineHolder) [][]string {
+	all := [][]string{}
+	for line := 1; line <= lines.Lines(); line++ {
+		words := []string{}
+		for word := 1; word <= lines.Words(line); word++ {
+			words = append(words, string(WordBytes(lines, line, word)))
+		}
+		all = append(all, words)
+	}
+	return all
+}
+
+func TestLineStorageDelete(t *testing.T) {
+	tests := []struct {
+		name      string
+		delete    func(storage *LineStorage) error
+		want      [][]string
+		originals []int
+		wantErr   error
+	}{
+		{"middle line", func(s *LineStorage) error { return s.DeleteLine(2) },
+			[][]string{{"the", "quick", "fox"}, {"a"}}, []int{1, 4}, nil},
+		{"first line", func(s *LineStorage) error { return s.DeleteLine(1) },
+			[][]string{{"jumped", "over"}, {"a"}}, []int{2, 4}, nil},
+		{"last line", func(s *LineStorage) error { return s.DeleteLine(3) },
+			[][]string{{"the", "quick", "fox"}, {"jumped", "over"}}, []int{1, 2}, nil},
+		{"middle word", func(s *LineStorage) error { return s.DeleteWord(1, 2) },
+			[][]string{{"the", "fox"}, {"jumped", "over"}, {"a"}}, []int{1, 2, 4}, nil},
+		{"last word", func(s *LineStorage) error { return s.DeleteWord(2, 2) },
+			[][]string{{"the", "quick", "fox"}, {"jumped"}, {"a"}}, []int{1, 2, 4}, nil},
+		{"only word", func(s *LineStorage) error { return s.DeleteWord(3, 1) },
+			[][]string{{"the", "quick", "fox"}, {"jumped", "over"}, {}}, []int{1, 2, 4}, nil},
+		{"line 0", func(s *LineStorage) error { return s.DeleteLine(0) }, nil, nil, ErrBadLine},
+		{"line past last", func(s *LineStorage) error { return s.DeleteLine(4) }, nil, nil, ErrBadLine},
+		{"word of line past last", func(s *LineStorage) error { return s.DeleteWord(4, 1) }, nil, nil, ErrBadLine},
+		{"word 0", func(s *LineStorage) error { return s.DeleteWord(1, 0) }, nil, nil, ErrBadWord},
+		{"word past last", func(s *LineStorage) error { return s.DeleteWord(2, 3) }, nil, nil, ErrBadWord},
+	}
+	for _, test := range tests {
+		storage := storageOf(t, "the quick fox\njumped over\n\na\n")
+		before := wordsOf(storage)
+		err := test.delete(storage)
+		if test.wantErr != nil {
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("%s: error %v, want %v", test.name, err, test.wantErr)
+			}
+			if fmt.Sprint(wordsOf(storage)) != fmt.Sprint(before) {
+				t.Errorf("%s: failed deletion changed %q to %q", test.name, before, wordsOf(storage))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := wordsOf(storage); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: left %q, want %q", test.name, got, test.want)
+		}
+		for line, want := range test.originals {
+			if got := storage.OriginalLine(line + 1); got != want {
+				t.Errorf("%s: line %d came from line %d, want %d", test.name, line+1, got, want)
+			}
+		}
+		for line := 1; line <= storage.Lines(); line++ {
+			for word := 1; word <= storage.Words(line); word++ {
+				if chars := storage.Chars(line, word); chars != len([]rune(test.want[line-1][word-1])) {
+					t.Errorf("%s: word %d of line %d has %d characters, want %d",
+						test.name, word, line, chars, len([]rune(test.want[line-1][word-1])))
+				}
+			}
+		}
+	}
+}
+
+func TestSyncStorageSnapshot(t *testing.T) {
+	storage := &SyncStorage{}
+	if err := InputFrom(strings.NewReader("the quick fox\njumped over\n"), storage, InputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := storage.Snapshot()
+	want := fmt.Sprint(wordsOf(snapshot))
+	// Change every line the snapshot has, and add to the last.
+	storage.SetWord(2, 2, 5, 's')
+	storage.SetWord(2, 3, 1, 'a')
+	storage.ReplaceWord(1, 1, []byte("a"))
+	storage.DeleteWord(1, 2)
+	storage.DeleteLine(2)
+	storage.AppendLine([]byte("new"))
+	if got := fmt.Sprint(wordsOf(snapshot)); got != want {
+		t.Errorf("snapshot changed from %s to %s", want, got)
+	}
+	if got, want := fmt.Sprint(wordsOf(storage)), "[[a fox] [new]]"; got != want {
+		t.Errorf("storage holds %s, want %s", got, want)
+	}
+}
+
+// TestSyncStorageConcurrent is most useful run with -race.
+func TestSyncStorageConcurrent(t *testing.T) {
+	storage := &SyncStorage{}
+	storage.AppendLine([]byte("first"), []byte("line"))
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			storage.AppendLine([]byte(fmt.Sprintf("word%d", i)), []byte("more"), []byte("words"))
+			storage.ReplaceWord(storage.Lines(), 2, []byte(fmt.Sprintf("replaced%d", i)))
+			if i%3 == 0 {
+				storage.DeleteWord(storage.Lines(), 3)
+			}
+			if i%5 == 0 {
+				storage.DeleteLine(1)
+			}
+			InputFrom(strings.NewReader("typed in\n"), storage, InputOptions{})
+		}
+	}()
+	var readers sync.WaitGroup
+	for reader := 0; reader < 3; reader++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				snapshot := storage.Snapshot()
+				index := NewAlphabetizer(NewCircularShifter(snapshot))
+				var first, second bytes.Buffer
+				if _, err := OutputNumbered(&first, index); err != nil {
+					t.Error(err)
+					return
+				}
+				// The writer's changes since don't affect the snapshot.
+				OutputNumbered(&second, NewAlphabetizer(NewCircularShifter(snapshot)))
+				if first.String() != second.String() {
+					t.Errorf("snapshot changed while it was read")
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	readers.Wait()
+}
+
+func TestStorageFromString(t *testing.T) {
+	tests := []string{
+		"",
+		"\n",
+		"one",
+		"the quick fox\njumped over\n",
+		"windows\r\nline endings\r\n",
+		"  runs  of   spaces \n \n\nafter blank lines",
+		"no final newline\nhere",
+		"a\rbare carriage return\n",
+		"café crème\tÉclair 日本語\n",
+	}
+	for _, text := range tests {
+		got := StorageFromString(text)
+		want := &LineStorage{}
+		if err := InputFrom(strings.NewReader(text), want, InputOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(wordsOf(got)) != fmt.Sprint(wordsOf(want)) {
+			t.Errorf("%q: stored %q, want %q", text, wordsOf(got), wordsOf(want))
+		}
+		for line := 1; line <= got.Lines() && line <= want.Lines(); line++ {
+			if got.OriginalLine(line) != want.OriginalLine(line) {
+				t.Errorf("%q: line %d came from line %d, want %d", text, line, got.OriginalLine(line), want.OriginalLine(line))
+			}
+		}
+		gotIndex := render(t, func(w io.Writer) (int64, error) {
+			return OutputNumbered(w, NewAlphabetizer(NewCircularShifter(got)))
+		})
+		wantIndex := render(t, func(w io.Writer) (int64, error) {
+			return OutputNumbered(w, NewAlphabetizer(NewCircularShifter(want)))
+		})
+		if gotIndex != wantIndex {
+			t.Errorf("%q: index is\n%s\nwant\n%s", text, gotIndex, wantIndex)
+		}
+	}
+}
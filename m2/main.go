@@ -1,298 +1,789 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ongardie/parnas/m2/kwic"
 )
 
-type lineHolder interface {
-	// char returns the requested character of a word in a line.
-	char(line, word, char int) byte
-	// lines returns the total number of lines.
-	lines() int
-	// words returns the number of words in a line.
-	words(line int) int
-	// chars returns the number of characters in a word.
-	chars(line, word int) int
+// finalNewlineTrimmer is a writer that holds back a trailing newline until more
+// is written, so that the very last newline written is dropped.
+type finalNewlineTrimmer struct {
+	w       io.Writer
+	pending bool
 }
 
-// Module 1: Line Storage
-
-type lineStorage struct {
-	array [][][]byte
+func (trimmer *finalNewlineTrimmer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if trimmer.pending {
+		_, err := trimmer.w.Write([]byte{'\n'})
+		if err != nil {
+			return 0, err
+		}
+		trimmer.pending = false
+	}
+	n := len(p)
+	if p[n-1] == '\n' {
+		p = p[:n-1]
+		trimmer.pending = true
+	}
+	_, err := trimmer.w.Write(p)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
-func (storage *lineStorage) char(line, word, char int) byte {
-	return storage.array[line-1][word-1][char-1]
+// byteCounter counts the bytes written through it to w.
+type byteCounter struct {
+	w io.Writer
+	n int64
 }
 
-func (storage *lineStorage) lines() int {
-	return len(storage.array)
+func (counter *byteCounter) Write(p []byte) (int, error) {
+	n, err := counter.w.Write(p)
+	counter.n += int64(n)
+	return n, err
 }
 
-func (storage *lineStorage) words(line int) int {
-	return len(storage.array[line-1])
+// ANSI escape sequences to start and end bold text.
+const (
+	ansiBold  = "\x1b[1m"
+	ansiReset = "\x1b[0m"
+)
+
+// keywordMarkers returns the text to write on either side of each keyword for
+// -mark-left and -mark-right, with a -color mode of auto, always, or never.
+// Bold is used for auto if terminal.
+func keywordMarkers(left, right, color string, terminal bool) (string, string, error) {
+	switch color {
+	case "always":
+		return ansiBold + left, right + ansiReset, nil
+	case "auto":
+		if terminal {
+			return ansiBold + left, right + ansiReset, nil
+		}
+		return left, right, nil
+	case "never":
+		return left, right, nil
+	}
+	return "", "", fmt.Errorf("unknown color mode %q: want auto, always, or never", color)
 }
 
-func (storage *lineStorage) chars(line, word int) int {
-	return len(storage.array[line-1][word-1])
+// refuseFlagsExcept exits with an error if any flag other than allowed was set
+// on the command line, saying that mode can't be combined with it.
+func refuseFlagsExcept(mode string, allowed ...string) {
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range allowed {
+			if f.Name == name {
+				return
+			}
+		}
+		log.Fatalf("%s can't be combined with -%s", mode, f.Name)
+	})
 }
 
-// setWord adds a character to the last word, a new word on the last line, or a
-// new word on a new line.
-func (storage *lineStorage) setWord(line, word, char int, value byte) {
-	lines := storage.lines()
-	if line < lines || line > lines+1 {
-		panic("Line not last or just past last (ERLSBL)")
-	}
-	words := 0
-	if line == lines {
-		words = storage.words(line)
-	}
-	if word < words || word > words+1 {
-		panic("Word not last or just past last (ERLSBW)")
-	}
-	chars := 0
-	if line == lines && word == words {
-		chars = storage.chars(line, word)
-	}
-	if char != chars+1 {
-		panic("Char not just past last (ERLSBC)")
+// parseRange parses a -range of input lines, first:last, where first and last
+// are line numbers and first is no greater than last.
+func parseRange(s string) (first, last int, err error) {
+	firstText, lastText, ok := strings.Cut(s, ":")
+	if ok {
+		first, err = strconv.Atoi(firstText)
 	}
-	if line == lines+1 {
-		storage.array = append(storage.array, nil)
+	if ok && err == nil {
+		last, err = strconv.Atoi(lastText)
 	}
-	if word == words+1 {
-		storage.array[line-1] = append(storage.array[line-1], nil)
+	if !ok || err != nil || first < 1 || last < first {
+		return 0, 0, fmt.Errorf("invalid line range %q: want first:last, line numbers with first no greater than last", s)
 	}
-	storage.array[line-1][word-1] = append(storage.array[line-1][word-1], value)
+	return first, last, nil
 }
 
-// deleteWord and deleteLine are unused and not implemented.
+// isTerminal reports whether file is a terminal (or another character device).
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
-// Module 2: Input
+// watchInterval is how often -watch checks whether the input has changed.
+const watchInterval = 500 * time.Millisecond
 
-func input(filename string, storage *lineStorage) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	buf := make([]byte, 1)
-	line, word, char := 1, 1, 1
-	for {
-		n, err := file.Read(buf)
-		if err == io.EOF {
-			break
-		}
+// inputStamp summarizes the sizes and modification times of the named files, so
+// that it changes when any of them does. It reports false if any can't be found,
+// as while an editor replaces one.
+func inputStamp(filenames []string) (string, bool) {
+	var stamp strings.Builder
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
 		if err != nil {
-			return err
+			return "", false
 		}
-		if n == 0 {
+		fmt.Fprintf(&stamp, "%d %d\n", info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp.String(), true
+}
+
+// watchInputs runs this program again with args, less any -watch flag, each
+// time the named files change, stopping the previous run first if it's still
+// going, as a server is. It never returns.
+func watchInputs(filenames, args []string) {
+	childArgs := []string{}
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if arg != name && (name == "watch" || strings.HasPrefix(name, "watch=")) {
 			continue
 		}
-		if buf[0] == ' ' {
-			word++
-			char = 1
-		} else if buf[0] == '\n' {
-			line++
-			word, char = 1, 1
-		} else {
-			storage.setWord(line, word, char, buf[0])
-			char++
+		childArgs = append(childArgs, arg)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Error finding this program to run again: %v", err)
+	}
+	var child *exec.Cmd
+	last := ""
+	for {
+		stamp, ok := inputStamp(filenames)
+		if ok && stamp != last {
+			if child != nil {
+				log.Printf("Input changed; indexing it again")
+				// Stop the previous run if it hasn't finished.
+				child.Process.Kill()
+				child.Wait()
+			}
+			child = exec.Command(self, childArgs...)
+			child.Stdout, child.Stderr = os.Stdout, os.Stderr
+			err = child.Start()
+			if err != nil {
+				log.Fatalf("Error running %v: %v", self, err)
+			}
+			last = stamp
 		}
+		time.Sleep(watchInterval)
 	}
-	return nil
-}
-
-// Module 3: Circular Shifter
-
-type circularShifter struct {
-	storage lineHolder
-	shifts  []shift
 }
 
-type shift struct {
-	line      int
-	startWord int
-}
+// Module 6: Master Control
 
-func newCircularShifter(storage lineHolder) lineHolder {
-	shifter := &circularShifter{storage: storage}
-	for line := 1; line <= storage.lines(); line++ {
-		for word := 1; word <= storage.words(line); word++ {
-			shifter.shifts = append(shifter.shifts, shift{line, word})
+func main() {
+	outputPath := flag.String("output", "", "write the index to this file instead of standard output")
+	format := flag.String("format", "text", "output format: text, aligned, json, html, ptx, hashed, csv, prefixed, partial, orphans, or inverted")
+	width := flag.Int("width", 30, "with aligned format, the width of the context on each side of the keyword")
+	lineRange := flag.String("range", "", "index only input lines first:last, as for a partial index")
+	merge := flag.Bool("merge", false, "merge the partial indexes named as arguments")
+	csvHeader := flag.Bool("csv-header", false, "with csv format, begin with a header row")
+	csvSplit := flag.Bool("csv-split", false, "with csv format, write the context before and after the keyword and the source line as separate fields")
+	csvDelimiter := flag.String("csv-delimiter", ",", "with csv format, separate fields with this character")
+	inputFormat := flag.String("input-format", "text", "input format: text or prefixed")
+	count := flag.Bool("count", false, "with text format, write repeated entries once, prefixed with how many times they occur")
+	lineNumbers := flag.Bool("line-numbers", false, "with text format, prefix lines with the numbers of the input lines they came from")
+	refs := flag.String("refs", "", "with text format, put the number of the input line each line came from before it (prefix, as -line-numbers does) or after it (suffix)")
+	rtl := flag.Bool("rtl", false, "with text format, write lines right to left")
+	showKeys := flag.Bool("showkeys", false, "with text format, prefix lines with their keywords' normalized sort keys")
+	indent := flag.String("indent", "", "with text format, indent each line by this once per rotated word")
+	useSoundex := flag.Bool("soundex", false, "group keywords that sound alike by sorting on their Soundex codes")
+	markLeft := flag.String("mark-left", "", "with text format, insert this before each keyword")
+	markRight := flag.String("mark-right", "", "with text format, insert this after each keyword")
+	color := flag.String("color", "auto", "with text format, show keywords in bold: auto (if writing to a terminal), always, or never")
+	parallel := flag.Int("parallel", 0, "if positive, sort on at most this many threads instead of one per CPU")
+	outputWorkers := flag.Int("output-workers", 1, "with text format, render output on this many goroutines")
+	noFinalNewline := flag.Bool("no-final-newline", false, "don't terminate the last line of output")
+	maxWords := flag.Int("max-words", 0, "if positive, leave out input lines with more than this many words")
+	showStats := flag.Bool("stats", false, "print statistics about the input to stderr")
+	limit := flag.Int("n", 0, "if positive, output only the first this many entries")
+	keyword := flag.String("keyword", "", "output only entries with this keyword")
+	contains := flag.String("contains", "", "output only entries containing this word")
+	dumpPath := flag.String("dumpstate", "", "write the internal state of the pipeline to this file")
+	fold := flag.Bool("fold", false, "store input words in lowercase")
+	separators := flag.String("separators", " ", "characters that separate words in text input")
+	splitHyphens := flag.Bool("split-hyphens", false, "separate words at hyphens in text input")
+	splitSlashes := flag.Bool("split-slashes", false, "separate words at slashes in text input")
+	trimPunct := flag.Bool("trim-punct", false, "drop punctuation from the beginnings and ends of words in text input")
+	bareCR := flag.Bool("bare-cr", false, "end lines at carriage returns not followed by newlines, as in old Mac files")
+	maxBinary := flag.Float64("max-binary", 0, "if positive, reject text input if more than this fraction of its first characters aren't text, such as 0.1, or if it has a NUL")
+	batch := flag.Int("batch", 0, "if positive, index the input this many lines at a time through temporary files, to limit memory use (output still begins only after all input is read)")
+	packed := flag.Bool("packed", false, "store the input in one block of memory, which takes less of it")
+	useMmap := flag.Bool("mmap", false, "memory-map the input file instead of reading it into memory")
+	useNoise := flag.Bool("noise", false, "leave out shifts beginning with common English words")
+	noiseFile := flag.String("noise-file", "", "leave out shifts beginning with the words listed in this file")
+	onlyFile := flag.String("only-file", "", "output only shifts beginning with the words listed in this file")
+	caseOrder := flag.String("case-order", "", "sort ignoring case, putting words that differ only in case in this order: upper or lower (first)")
+	codePoint := flag.Bool("codepoint", false, "sort characters by their Unicode code points alone, putting all uppercase letters before lowercase ones")
+	numeric := flag.Bool("numeric", false, "sort runs of digits by their numeric values")
+	lang := flag.String("lang", "", "sort letters in the alphabetical order of this language, such as sv or es")
+	desc := flag.Bool("desc", false, "sort in descending order")
+	reverseShift := flag.Bool("reverse-shift", false, "rotate lines to end with each keyword instead of beginning with it")
+	minKeywordLen := flag.Int("min-keyword-len", 0, "leave out shifts beginning with words of fewer than this many characters")
+	unique := flag.Bool("unique", false, "leave out circular shifts identical to earlier ones")
+	cache := flag.Bool("cache", false, "compute the lengths of words and lines once before writing output")
+	noShift := flag.Bool("no-shift", false, "sort the input lines as they are instead of indexing their circular shifts")
+	materialize := flag.Bool("materialize", false, "copy the circular shifts into memory before sorting them")
+	interactive := flag.Bool("interactive", false, "instead of writing the index, read prefixes from standard input and write the entries whose keywords begin with each")
+	serve := flag.String("serve", "", "instead of writing the index, serve it over HTTP at this address, with /index as HTML and /search?q=prefix as JSON")
+	lazy := flag.Bool("lazy", false, "find circular shifts as they're needed instead of storing them all")
+	savePath := flag.String("save", "", "instead of writing the index, save it to this file to be read with -load")
+	loadPath := flag.String("load", "", "read the index saved in this file with -save instead of building it from input")
+	watch := flag.Bool("watch", false, "keep running, and index the input files again, or serve them again, whenever they change")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file ...]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Writes a KWIC index of the named files, or of input.txt if none are named.\nA file named - is standard input, which is also read if no files are named,\nthere's no input.txt, and standard input isn't a terminal.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *parallel > 0 {
+		runtime.GOMAXPROCS(*parallel)
+	}
+	// Check these before reading any input, which may take a while.
+	switch *format {
+	case "text", "aligned", "json", "html", "ptx", "hashed", "csv", "prefixed", "partial", "orphans", "inverted":
+	default:
+		log.Fatalf("Unknown output format %q", *format)
+	}
+	switch *inputFormat {
+	case "text", "prefixed":
+	default:
+		log.Fatalf("Unknown input format %q", *inputFormat)
+	}
+	switch *refs {
+	case "", "prefix", "suffix":
+	default:
+		log.Fatalf("Unknown line reference position %q: want prefix or suffix", *refs)
+	}
+	var rangeFirst, rangeLast int
+	if *lineRange != "" {
+		var err error
+		rangeFirst, rangeLast, err = parseRange(*lineRange)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-	return shifter
-}
-
-func (shifter *circularShifter) char(line, word, char int) byte {
-	shift := shifter.shifts[line-1]
-	word += shift.startWord
-	words := shifter.storage.words(shift.line)
-	if word > words {
-		word -= words
-	}
-	return shifter.storage.char(shift.line, word, char)
-}
-
-func (shifter *circularShifter) lines() int {
-	return len(shifter.shifts)
-}
-
-func (shifter *circularShifter) words(line int) int {
-	shift := shifter.shifts[line-1]
-	return shifter.storage.words(shift.line)
-}
-
-func (shifter *circularShifter) chars(line, word int) int {
-	shift := shifter.shifts[line-1]
-	word += shift.startWord
-	words := shifter.storage.words(shift.line)
-	if word > words {
-		word -= words
-	}
-	return shifter.storage.chars(shift.line, word)
-}
-
-// Module 4: Alphabetizer
-
-type alphabetizer struct {
-	storage lineHolder
-	perm    []int
-}
-
-func newAlphabetizer(lines lineHolder) lineHolder {
-	perm := make([]int, lines.lines())
-	for i := range perm {
-		perm[i] = i + 1
-	}
-	var quickSort func(left, right int)
-	quickSort = func(left, right int) {
-		if right-left <= 1 {
+	// Options that only one output format uses, or that choose between
+	// alternatives, are refused rather than silently ignored.
+	formatOf := map[string]string{
+		"count": "text", "line-numbers": "text", "refs": "text", "rtl": "text", "showkeys": "text",
+		"indent": "text", "mark-left": "text", "mark-right": "text", "color": "text",
+		"output-workers": "text", "width": "aligned", "csv-header": "csv",
+		"csv-split": "csv", "csv-delimiter": "csv",
+	}
+	var layouts, orders []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Value.String() == f.DefValue {
 			return
 		}
-		pivot := left
-		// Invariants: line[perm[elements left of pivot]] < line[perm[pivot]], i > pivot
-		for i := pivot + 1; i < right; i++ {
-			if linesLess(lines, perm[i], perm[pivot]) {
-				if i == pivot+1 {
-					perm[pivot], perm[i] = perm[i], perm[pivot]
+		if want, ok := formatOf[f.Name]; ok && want != *format {
+			log.Fatalf("-%s only applies to %s format, not %s", f.Name, want, *format)
+		}
+		switch f.Name {
+		case "count", "line-numbers", "refs", "showkeys", "rtl", "indent":
+			layouts = append(layouts, "-"+f.Name)
+		case "soundex", "numeric", "codepoint", "case-order", "lang":
+			orders = append(orders, "-"+f.Name)
+		}
+	})
+	if len(layouts) > 1 {
+		log.Fatalf("Only one of -count, -line-numbers, -refs, -showkeys, -rtl, and -indent can be used, not %s", strings.Join(layouts, " and "))
+	}
+	if len(layouts) > 0 && *outputWorkers != 1 {
+		log.Fatalf("-output-workers can't be combined with %s", layouts[0])
+	}
+	if len(orders) > 1 {
+		log.Fatalf("Only one of -soundex, -numeric, -codepoint, -case-order, and -lang can be used, not %s", strings.Join(orders, " and "))
+	}
+	var langCollator kwic.Collator
+	if *lang != "" {
+		var err error
+		langCollator, err = kwic.LanguageCollator(*lang)
+		if err != nil {
+			log.Fatalf("Error in kwic.LanguageCollator: %v", err)
+		}
+	}
+	// kwic.Lookup relies on the default order, and saved indexes don't record
+	// any other.
+	defaultOrder := *format != "ptx" && !*useSoundex && !*numeric && !*codePoint && *caseOrder == "" && *lang == "" && !*desc
+	if *savePath != "" && !defaultOrder {
+		log.Fatalf("Only an index in the default sort order can be saved")
+	}
+	if *format == "partial" && !defaultOrder {
+		// kwic.SortKey, by which partial indexes are merged, orders them
+		// as kwic.LinesLess does.
+		log.Fatalf("Partial indexes are merged in the default sort order, so -format partial can't be combined with -soundex, -numeric, -codepoint, -case-order, -lang, or -desc")
+	}
+	dest := os.Stdout
+	if *outputPath != "" {
+		file, err := os.Create(*outputPath)
+		if err != nil {
+			log.Fatalf("Error creating %v: %v", *outputPath, err)
+		}
+		defer func() {
+			if err := file.Close(); err != nil {
+				log.Fatalf("Error writing %v: %v", *outputPath, err)
+			}
+		}()
+		dest = file
+	}
+	stdout := &byteCounter{w: dest}
+	var out io.Writer = stdout
+	if *noFinalNewline {
+		out = &finalNewlineTrimmer{w: out}
+	}
+	if *merge {
+		// Merging only combines partial indexes already sorted and shifted.
+		refuseFlagsExcept("Merging partial indexes", "merge", "output", "format", "no-final-newline", "parallel")
+		if *format != "text" {
+			log.Fatalf("Merging partial indexes only writes text format")
+		}
+		partials := []io.Reader{}
+		for _, filename := range flag.Args() {
+			file, err := os.Open(filename)
+			if err != nil {
+				log.Fatalf("Error opening partial index: %v", err)
+			}
+			defer file.Close()
+			partials = append(partials, file)
+		}
+		_, err := kwic.MergePartials(out, partials)
+		if err != nil {
+			log.Fatalf("Error in kwic.MergePartials: %v", err)
+		}
+		return
+	}
+	filenames := flag.Args()
+	if len(filenames) == 0 {
+		filenames = []string{"input.txt"}
+		if _, err := os.Stat("input.txt"); os.IsNotExist(err) && !isTerminal(os.Stdin) {
+			filenames = []string{"-"}
+		}
+	}
+	if *watch {
+		for _, filename := range filenames {
+			if filename == "-" {
+				log.Fatalf("Standard input can't be watched for changes")
+			}
+		}
+		if *loadPath != "" {
+			log.Fatalf("Only input files can be watched for changes")
+		}
+		if *interactive {
+			log.Fatalf("Interactive queries can't be combined with -watch")
+		}
+		watchInputs(filenames, os.Args[1:])
+	}
+	inputOpts := kwic.InputOptions{
+		Fold:         *fold,
+		BareCR:       *bareCR,
+		Separators:   *separators,
+		SplitHyphens: *splitHyphens,
+		SplitSlashes: *splitSlashes,
+		TrimPunct:    *trimPunct,
+		MaxBinary:    *maxBinary,
+	}
+	if *batch > 0 {
+		// Batches go through the default pipeline, which only the input
+		// options can change.
+		refuseFlagsExcept("Batched indexing",
+			"batch", "fold", "separators", "split-hyphens", "split-slashes", "trim-punct",
+			"bare-cr", "max-binary", "no-final-newline", "parallel", "output", "format")
+		if *format != "text" {
+			log.Fatalf("Batched indexing only writes text format")
+		}
+		inputs := []io.Reader{}
+		for _, filename := range filenames {
+			if filename == "-" {
+				inputs = append(inputs, os.Stdin)
+				continue
+			}
+			file, err := os.Open(filename)
+			if err != nil {
+				log.Fatalf("Error opening %v: %v", filename, err)
+			}
+			defer file.Close()
+			inputs = append(inputs, file)
+		}
+		_, err := kwic.IndexBatched(out, *batch, inputOpts, inputs...)
+		if err != nil {
+			log.Fatalf("Error in kwic.IndexBatched: %v", err)
+		}
+		return
+	}
+	var storage kwic.LineHolder
+	var saved *kwic.SavedIndex
+	if *loadPath != "" {
+		// A saved index was already read, shifted, and sorted.
+		unused := map[string]bool{
+			"separators": true, "split-hyphens": true, "split-slashes": true,
+			"trim-punct": true, "bare-cr": true, "max-binary": true,
+			"packed": true, "mmap": true, "input-format": true, "range": true,
+			"max-words": true, "noise": true, "noise-file": true,
+			"only-file": true, "min-keyword-len": true, "unique": true,
+			"reverse-shift": true, "no-shift": true, "lazy": true,
+			"materialize": true, "keyword": true, "contains": true, "n": true,
+			"soundex": true, "numeric": true, "codepoint": true,
+			"case-order": true, "lang": true, "desc": true,
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if unused[f.Name] {
+				log.Fatalf("A loaded index can't be combined with -%s", f.Name)
+			}
+		})
+		if len(flag.Args()) > 0 {
+			log.Fatalf("A loaded index can't be combined with input files")
+		}
+		if *format == "ptx" {
+			log.Fatalf("A loaded index is in the default sort order, not sorted by keyword for ptx format")
+		}
+		filenames = nil
+		var err error
+		saved, err = kwic.LoadIndex(*loadPath)
+		if err != nil {
+			log.Fatalf("Error in kwic.LoadIndex(%v): %v", *loadPath, err)
+		}
+		storage = saved.Storage
+	} else if *useMmap {
+		if *fold {
+			log.Fatalf("Memory-mapped input can't be folded")
+		}
+		if *trimPunct {
+			log.Fatalf("Memory-mapped input can't have punctuation trimmed")
+		}
+		if *separators != " " || *splitHyphens || *splitSlashes {
+			log.Fatalf("Memory-mapped input only separates words with spaces")
+		}
+		if *bareCR {
+			log.Fatalf("Memory-mapped input always treats bare carriage returns as characters")
+		}
+		if *inputFormat != "text" {
+			log.Fatalf("Memory-mapped input must be in text format")
+		}
+		if *packed {
+			log.Fatalf("Memory-mapped input can't also be packed")
+		}
+		if len(filenames) > 1 {
+			log.Fatalf("Only one file can be memory-mapped")
+		}
+		filename := filenames[0]
+		if filename == "-" {
+			log.Fatalf("Standard input can't be memory-mapped")
+		}
+		mapped, err := kwic.NewMmapStorage(filename)
+		if err != nil {
+			log.Fatalf("Error in kwic.NewMmapStorage(%v): %v", filename, err)
+		}
+		defer mapped.Close()
+		storage = mapped
+	} else {
+		// Lines from each file are added after those of the previous files.
+		var loaded kwic.LineBuilder = &kwic.LineStorage{}
+		if *packed {
+			loaded = &kwic.PackedStorage{}
+		}
+		for _, filename := range filenames {
+			switch *inputFormat {
+			case "text":
+				var err error
+				if filename == "-" {
+					err = kwic.InputFrom(os.Stdin, loaded, inputOpts)
 				} else {
-					perm[pivot], perm[pivot+1], perm[i] = perm[i], perm[pivot], perm[pivot+1]
+					err = kwic.Input(filename, loaded, inputOpts)
+				}
+				if err != nil {
+					log.Fatalf("Error in kwic.Input(%v): %v", filename, err)
+				}
+			case "prefixed":
+				var err error
+				if filename == "-" {
+					err = kwic.InputPrefixedFrom(os.Stdin, loaded, inputOpts)
+				} else {
+					err = kwic.InputPrefixed(filename, loaded, inputOpts)
+				}
+				if err != nil {
+					log.Fatalf("Error in kwic.InputPrefixed(%v): %v", filename, err)
 				}
-				pivot++
 			}
 		}
-		quickSort(left, pivot)
-		quickSort(pivot+1, right)
+		storage = loaded
 	}
-	quickSort(0, len(perm))
-	return &alphabetizer{lines, perm}
-}
-
-func (alpha *alphabetizer) char(line, word, char int) byte {
-	return alpha.storage.char(alpha.perm[line-1], word, char)
-}
-
-func (alpha *alphabetizer) lines() int {
-	return alpha.storage.lines()
-}
-
-func (alpha *alphabetizer) words(line int) int {
-	return alpha.storage.words(alpha.perm[line-1])
-}
-
-func (alpha *alphabetizer) chars(line, word int) int {
-	return alpha.storage.chars(alpha.perm[line-1], word)
-}
-
-func normalizeChar(char byte) byte {
-	if char >= 'A' && char <= 'Z' {
-		return (char - 'A') * 2
+	filtered := storage
+	if *lineRange != "" {
+		filtered = kwic.NewLineFilter(filtered, func(line int) bool {
+			original := kwic.OriginalLineOf(storage, line)
+			return original >= rangeFirst && original <= rangeLast
+		})
 	}
-	if char >= 'a' && char <= 'z' {
-		return (char-'a')*2 + 1
+	if *maxWords > 0 {
+		filtered = kwic.NewMaxWordsFilter(filtered, *maxWords)
 	}
-	return 0
-}
-
-func wordsLess(lines lineHolder, line1, word1, line2, word2 int) bool {
-	chars1 := lines.chars(line1, word1)
-	chars2 := lines.chars(line2, word2)
-	char := 1
-	for {
-		if char > chars1 && char <= chars2 {
-			return true
+	noise := map[string]bool{}
+	if *useNoise {
+		noise = kwic.EnglishNoiseWords()
+	}
+	if *noiseFile != "" {
+		file, err := os.Open(*noiseFile)
+		if err != nil {
+			log.Fatalf("Error opening noise words: %v", err)
 		}
-		if char > chars2 {
-			return false
+		words, err := kwic.ReadNoiseWords(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Error reading %v: %v", *noiseFile, err)
 		}
-		n1 := normalizeChar(lines.char(line1, word1, char))
-		n2 := normalizeChar(lines.char(line2, word2, char))
-		if n1 < n2 {
-			return true
-		} else if n1 > n2 {
-			return false
+		for word := range words {
+			noise[word] = true
 		}
-		char++
 	}
-}
-
-func linesLess(lines lineHolder, line1, line2 int) bool {
-	words1 := lines.words(line1)
-	words2 := lines.words(line2)
-	word := 1
-	for {
-		if word > words1 && word <= words2 {
-			return true
+	only := map[string]bool{}
+	if *onlyFile != "" {
+		file, err := os.Open(*onlyFile)
+		if err != nil {
+			log.Fatalf("Error opening keywords: %v", err)
 		}
-		if word > words2 {
-			return false
+		only, err = kwic.ReadNoiseWords(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Error reading %v: %v", *onlyFile, err)
 		}
-		if wordsLess(lines, line1, word, line2, word) {
-			return true
+	}
+	var shifted kwic.LineHolder
+	if saved != nil {
+		shifted = saved.Shifts
+	} else if *noShift {
+		if len(noise) > 0 || len(only) > 0 || *minKeywordLen > 1 || *unique || *reverseShift || *lazy {
+			log.Fatalf("Unshifted lines can't leave out any shifts or be reversed")
 		}
-		if wordsLess(lines, line2, word, line1, word) {
-			return false
+		// Each line is presented once, beginning with its first word.
+		shifted = filtered
+	} else if *lazy {
+		if len(noise) > 0 || len(only) > 0 || *minKeywordLen > 1 || *unique || *reverseShift {
+			log.Fatalf("Lazy circular shifts can't leave out any shifts or be reversed")
 		}
-		word++
+		shifted = kwic.NewLazyCircularShifter(filtered)
+	} else {
+		shifted = kwic.NewCircularShifterWith(filtered, kwic.ShiftOptions{
+			Noise:      noise,
+			Only:       only,
+			MinKeyword: *minKeywordLen,
+			Unique:     *unique,
+			Reverse:    *reverseShift,
+		})
 	}
-}
-
-// wordsEqual and linesEqual are unused and not implemented.
-
-// Module 5: Output
-
-func output(w io.Writer, lines lineHolder) {
-	for line := 1; line <= lines.lines(); line++ {
-		for word := 1; word <= lines.words(line); word++ {
-			for char := 1; char <= lines.chars(line, word); char++ {
-				w.Write([]byte{lines.char(line, word, char)})
+	if *materialize {
+		shifted = kwic.NewMaterializedHolder(shifted)
+	}
+	selected := shifted
+	if *keyword != "" {
+		query := []rune(*keyword)
+		for i := range query {
+			query[i] = kwic.InputOptions{Fold: *fold}.StoredChar(query[i])
+		}
+		selected = kwic.NewKeywordFilter(selected, query)
+	}
+	if *contains != "" {
+		query := []rune(*contains)
+		for i := range query {
+			query[i] = kwic.InputOptions{Fold: *fold}.StoredChar(query[i])
+		}
+		selected = kwic.NewContainsFilter(selected, query)
+	}
+	collator := kwic.DefaultCollator
+	if *format == "ptx" {
+		// ptx sorts entries by their keywords alone.
+		collator = kwic.CollatorFunc(kwic.KeywordLess)
+	} else if *useSoundex {
+		collator = kwic.CollatorFunc(kwic.SoundexLess)
+	} else if *numeric {
+		collator = kwic.NumericCollator
+	} else if *codePoint {
+		collator = kwic.CodePointCollator
+	} else if *lang != "" {
+		collator = langCollator
+	} else if *caseOrder != "" {
+		switch *caseOrder {
+		case "upper":
+			collator = kwic.CaseCollator{}
+		case "lower":
+			collator = kwic.CaseCollator{LowerFirst: true}
+		default:
+			log.Fatalf("Unknown case order %q: want upper or lower", *caseOrder)
+		}
+	}
+	if *desc {
+		collator = kwic.CollatorFunc(kwic.Descending(collator.Less))
+	}
+	var alphabetized kwic.LineHolder
+	if saved != nil {
+		alphabetized = saved.Sorted
+	} else if *limit > 0 {
+		alphabetized = kwic.NewAlphabetizerTop(selected, collator.Less, *limit)
+	} else {
+		alphabetized = kwic.NewCollatedAlphabetizer(selected, collator)
+	}
+	if *dumpPath != "" {
+		dump, err := os.Create(*dumpPath)
+		if err != nil {
+			log.Fatalf("Error creating %v: %v", *dumpPath, err)
+		}
+		buffered := bufio.NewWriter(dump)
+		kwic.DumpState(buffered, storage, shifted, alphabetized)
+		err = buffered.Flush()
+		if closeErr := dump.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatalf("Error writing %v: %v", *dumpPath, err)
+		}
+	}
+	if *savePath != "" {
+		err := kwic.SaveIndex(*savePath, alphabetized)
+		if err != nil {
+			log.Fatalf("Error in kwic.SaveIndex(%v): %v", *savePath, err)
+		}
+		return
+	}
+	if *cache {
+		alphabetized = kwic.NewCacheHolder(alphabetized)
+	}
+	foldQuery := func(prefix string) string {
+		query := []rune(prefix)
+		for i := range query {
+			query[i] = kwic.InputOptions{Fold: *fold}.StoredChar(query[i])
+		}
+		return string(query)
+	}
+	if *serve != "" {
+		if !defaultOrder {
+			log.Fatalf("Serving queries needs the default sort order")
+		}
+		http.HandleFunc("/index", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			kwic.OutputHTML(w, alphabetized)
+		})
+		http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(kwic.Lookup(alphabetized, foldQuery(r.URL.Query().Get("q"))))
+		})
+		log.Fatal(http.ListenAndServe(*serve, nil))
+	}
+	if *interactive {
+		if !defaultOrder {
+			log.Fatalf("Interactive queries need the default sort order")
+		}
+		for _, filename := range filenames {
+			if filename == "-" {
+				log.Fatalf("Interactive queries can't read the input from standard input")
+			}
+		}
+		prompt := isTerminal(os.Stdin)
+		scanner := bufio.NewScanner(os.Stdin)
+		for {
+			if prompt {
+				fmt.Fprint(os.Stderr, "> ")
+			}
+			if !scanner.Scan() {
+				break
+			}
+			query := strings.TrimSpace(scanner.Text())
+			if query == "" {
+				continue
+			}
+			buffered := bufio.NewWriter(out)
+			for _, entry := range kwic.Lookup(alphabetized, foldQuery(query)) {
+				if entry.SourceLine > 0 {
+					fmt.Fprintf(buffered, "%d\t", entry.SourceLine)
+				}
+				fmt.Fprintln(buffered, entry.Text)
 			}
-			if word < lines.words(line) {
-				w.Write([]byte{' '})
+			if err := buffered.Flush(); err != nil {
+				log.Fatalf("Error writing output: %v", err)
 			}
 		}
-		w.Write([]byte{'\n'})
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("Error reading queries: %v", err)
+		}
+		return
 	}
-}
-
-// Module 6: Master Control
-
-func main() {
-	filename := "input.txt"
-	if len(os.Args) > 1 {
-		filename = os.Args[1]
+	var err error
+	switch *format {
+	case "text":
+		left, right, markErr := keywordMarkers(*markLeft, *markRight, *color, isTerminal(dest))
+		if markErr != nil {
+			log.Fatal(markErr)
+		}
+		// OutputKeys still takes its keys from the unmarked lines.
+		if left != "" || right != "" {
+			alphabetized = kwic.NewMarkedHolder(alphabetized, left, right)
+		}
+		if *count {
+			_, err = kwic.OutputCounted(out, alphabetized)
+		} else if *lineNumbers || *refs == "prefix" {
+			_, err = kwic.OutputNumbered(out, alphabetized)
+		} else if *refs == "suffix" {
+			_, err = kwic.OutputNumberedAfter(out, alphabetized)
+		} else if *showKeys {
+			_, err = kwic.OutputKeys(out, alphabetized)
+		} else if *rtl {
+			_, err = kwic.OutputRTL(out, alphabetized)
+		} else if *indent != "" {
+			_, err = kwic.OutputIndented(out, alphabetized, *indent)
+		} else {
+			_, err = kwic.OutputParallel(out, alphabetized, *outputWorkers)
+		}
+	case "aligned":
+		if *width < 0 {
+			log.Fatalf("Width must not be negative, got %d", *width)
+		}
+		_, err = kwic.OutputAligned(out, alphabetized, *width)
+	case "json":
+		_, err = kwic.OutputJSON(out, alphabetized)
+	case "html":
+		_, err = kwic.OutputHTML(out, alphabetized)
+	case "ptx":
+		_, err = kwic.OutputPtx(out, alphabetized)
+	case "hashed":
+		_, err = kwic.OutputHashed(out, alphabetized)
+	case "csv":
+		comma, size := utf8.DecodeRuneInString(*csvDelimiter)
+		if size == 0 || size != len(*csvDelimiter) || strings.ContainsRune("\"\r\n", comma) {
+			log.Fatalf("CSV delimiter must be a single character other than a quote or newline, got %q", *csvDelimiter)
+		}
+		if *csvSplit {
+			_, err = kwic.OutputCSVSplit(out, alphabetized, *csvHeader, comma)
+		} else {
+			_, err = kwic.OutputCSV(out, alphabetized, *csvHeader, comma)
+		}
+	case "prefixed":
+		_, err = kwic.OutputPrefixed(out, alphabetized)
+	case "partial":
+		_, err = kwic.OutputPartial(out, alphabetized)
+	case "orphans":
+		_, err = kwic.Output(out, kwic.Orphans(storage, shifted))
+	case "inverted":
+		_, err = kwic.OutputInverted(out, kwic.InvertedIndex(storage))
 	}
-	storage := &lineStorage{}
-	err := input(filename, storage)
 	if err != nil {
-		log.Fatalf("Error in input(%v): %v", filename, err)
+		log.Fatalf("Error writing output: %v", err)
+	}
+	if *showStats {
+		kwic.PrintStats(os.Stderr, storage)
+		stats := kwic.CountStats(filtered, shifted)
+		fmt.Fprintf(os.Stderr, "indexed lines: %d\n", stats.Lines)
+		fmt.Fprintf(os.Stderr, "indexed words: %d\n", stats.Words)
+		if !*noShift {
+			fmt.Fprintf(os.Stderr, "shifts: %d\n", stats.Shifts)
+			fmt.Fprintf(os.Stderr, "suppressed shifts: %d\n", stats.Suppressed)
+		}
+		fmt.Fprintf(os.Stderr, "output bytes: %d\n", stdout.n)
 	}
-	shifted := newCircularShifter(storage)
-	alphabetized := newAlphabetizer(shifted)
-	output(os.Stdout, alphabetized)
 }
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/ongardie/parnas/m2/kwic"
+)
+
+// TestMain runs main instead of the tests when runKwic sets KWIC_TEST_MAIN, so
+// that tests can run the whole program.
+func TestMain(m *testing.M) {
+	if os.Getenv("KWIC_TEST_MAIN") != "" {
+		os.Args = append(os.Args[:1], strings.Fields(os.Getenv("KWIC_TEST_ARGS"))...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runKwic runs the program with args, which are separated by spaces, in the
+// directory dir, giving it input on standard input. It returns what the program
+// wrote to standard output, and to standard error if it failed.
+func runKwic(t *testing.T, dir, input, args string) (stdout, stderr string, err error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "KWIC_TEST_MAIN=1", "KWIC_TEST_ARGS="+args)
+	cmd.Stdin = strings.NewReader(input)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err = cmd.Run()
+	return out.String(), errOut.String(), err
+}
+
+func TestFinalNewlineTrimmer(t *testing.T) {
+	storage := &kwic.LineStorage{}
+	if err := kwic.InputFrom(strings.NewReader("the quick fox\njumped\n"), storage, kwic.InputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	index := kwic.NewAlphabetizer(kwic.NewCircularShifter(storage))
+	outputs := []struct {
+		name   string
+		output func(w io.Writer) (int64, error)
+	}{
+		{"text", func(w io.Writer) (int64, error) { return kwic.Output(w, index) }},
+		{"aligned", func(w io.Writer) (int64, error) { return kwic.OutputAligned(w, index, 10) }},
+		{"json", func(w io.Writer) (int64, error) { return kwic.OutputJSON(w, index) }},
+		{"csv", func(w io.Writer) (int64, error) { return kwic.OutputCSV(w, index, true, ',') }},
+		{"numbered", func(w io.Writer) (int64, error) { return kwic.OutputNumbered(w, index) }},
+	}
+	for _, test := range outputs {
+		var full, trimmed bytes.Buffer
+		if _, err := test.output(&full); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.output(&finalNewlineTrimmer{w: &trimmed}); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(full.String(), "\n") || trimmed.String() != strings.TrimSuffix(full.String(), "\n") {
+			t.Errorf("%s: trimmed output is %q, want %q without its final newline", test.name, trimmed.String(), full.String())
+		}
+	}
+	// Newlines held back by one write are written by the next.
+	writes := []struct {
+		writes []string
+		want   string
+	}{
+		{[]string{"a\n", "b\n"}, "a\nb"},
+		{[]string{"a\n", "", "\n", "b"}, "a\n\nb"},
+		{[]string{"\n"}, ""},
+		{[]string{"a\n\n"}, "a\n"},
+		{[]string{}, ""},
+	}
+	for _, test := range writes {
+		var out bytes.Buffer
+		trimmer := &finalNewlineTrimmer{w: &out}
+		for _, write := range test.writes {
+			if n, err := trimmer.Write([]byte(write)); n != len(write) || err != nil {
+				t.Errorf("Write(%q) = %d, %v, want %d, nil", write, n, err, len(write))
+			}
+		}
+		if out.String() != test.want {
+			t.Errorf("writes %q gave %q, want %q", test.writes, out.String(), test.want)
+		}
+	}
+}
+
+func TestKeywordMarkers(t *testing.T) {
+	tests := []struct {
+		color       string
+		terminal    bool
+		left, right string
+	}{
+		{"never", true, "[", "]"},
+		{"auto", false, "[", "]"},
+		{"auto", true, ansiBold + "[", "]" + ansiReset},
+		{"always", false, ansiBold + "[", "]" + ansiReset},
+	}
+	storage := &kwic.LineStorage{}
+	if err := kwic.InputFrom(strings.NewReader("b a\nc b\n"), storage, kwic.InputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	index := kwic.NewAlphabetizer(kwic.NewCircularShifter(storage))
+	var plain bytes.Buffer
+	if _, err := kwic.OutputKeys(&plain, index); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		left, right, err := keywordMarkers("[", "]", test.color, test.terminal)
+		if err != nil || left != test.left || right != test.right {
+			t.Errorf("%s on terminal %v: markers %q, %q, %v, want %q, %q", test.color, test.terminal, left, right, err, test.left, test.right)
+			continue
+		}
+		// -showkeys prints the keys of the bare keywords, however they're marked.
+		var out bytes.Buffer
+		if _, err := kwic.OutputKeys(&out, kwic.NewMarkedHolder(index, left, right)); err != nil {
+			t.Fatal(err)
+		}
+		gotLines, wantLines := strings.Split(out.String(), "\n"), strings.Split(plain.String(), "\n")
+		if len(gotLines) != len(wantLines) {
+			t.Fatalf("%s: wrote %q, want as many lines as %q", test.color, out.String(), plain.String())
+		}
+		for i := range wantLines {
+			gotKey, _, _ := strings.Cut(gotLines[i], "\t")
+			wantKey, _, _ := strings.Cut(wantLines[i], "\t")
+			if gotKey != wantKey {
+				t.Errorf("%s on terminal %v: key %q, want %q", test.color, test.terminal, gotKey, wantKey)
+			}
+		}
+	}
+	if _, _, err := keywordMarkers("", "", "sometimes", true); err == nil {
+		t.Errorf("no error for an unknown color mode")
+	}
+}
+
+func TestNoShift(t *testing.T) {
+	text := "the quick fox\n\njumped over\nthe lazy dog\na\n"
+	storage := &kwic.LineStorage{}
+	if err := kwic.InputFrom(strings.NewReader(text), storage, kwic.InputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"-no-shift -", "a\njumped over\nthe lazy dog\nthe quick fox\n"},
+		{"-no-shift -line-numbers -", "5\ta\n3\tjumped over\n4\tthe lazy dog\n1\tthe quick fox\n"},
+		{"-no-shift -format json -", ""},
+	}
+	for _, test := range tests {
+		out, stderr, err := runKwic(t, t.TempDir(), text, test.args)
+		if err != nil {
+			t.Fatalf("%s: %v: %s", test.args, err, stderr)
+		}
+		// Each stored line is one entry.
+		entries := strings.Count(out, "\n")
+		if strings.Contains(test.args, "json") {
+			entries = strings.Count(out, `"keyword"`)
+		}
+		if entries != storage.Lines() {
+			t.Errorf("%s: wrote %d entries for %d lines:\n%s", test.args, entries, storage.Lines(), out)
+		}
+		if test.want != "" && out != test.want {
+			t.Errorf("%s: wrote %q, want %q", test.args, out, test.want)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s           string
+		first, last int
+		ok          bool
+	}{
+		{"1:5", 1, 5, true},
+		{"3:3", 3, 3, true},
+		{"10:200", 10, 200, true},
+		{"1:5x", 0, 0, false},
+		{"x1:5", 0, 0, false},
+		{"1 :5", 0, 0, false},
+		{"1:", 0, 0, false},
+		{":5", 0, 0, false},
+		{"15", 0, 0, false},
+		{"1:2:3", 0, 0, false},
+		{"0:5", 0, 0, false},
+		{"5:1", 0, 0, false},
+		{"-2:5", 0, 0, false},
+	}
+	for _, test := range tests {
+		first, last, err := parseRange(test.s)
+		if (err == nil) != test.ok || first != test.first || last != test.last {
+			t.Errorf("parseRange(%q) = %d, %d, %v, want %d, %d and ok %v", test.s, first, last, err, test.first, test.last, test.ok)
+		}
+	}
+	// The program refuses a bad range before reading any input.
+	if _, stderr, err := runKwic(t, t.TempDir(), "a\nb\n", "-range 1:5x -"); err == nil || !strings.Contains(stderr, "invalid line range") {
+		t.Errorf("-range 1:5x: error %v, stderr %q", err, stderr)
+	}
+	if out, stderr, err := runKwic(t, t.TempDir(), "a\nb\nc\n", "-range 2:3 -"); err != nil || out != "b\nc\n" {
+		t.Errorf("-range 2:3 wrote %q, %v: %s", out, err, stderr)
+	}
+}
+
+func TestMergeFlags(t *testing.T) {
+	dir := t.TempDir()
+	for i, text := range []string{"b a\n", "c d\n"} {
+		if _, stderr, err := runKwic(t, dir, text, fmt.Sprintf("-format partial -output part%d -", i)); err != nil {
+			t.Fatalf("writing partial index: %v: %s", err, stderr)
+		}
+	}
+	if out, stderr, err := runKwic(t, dir, "", "-merge part0 part1"); err != nil || out != "a b\nb a\nc d\nd c\n" {
+		t.Errorf("-merge wrote %q, %v: %s", out, err, stderr)
+	}
+	if out, stderr, err := runKwic(t, dir, "", "-merge -no-final-newline part0 part1"); err != nil || out != "a b\nb a\nc d\nd c" {
+		t.Errorf("-merge -no-final-newline wrote %q, %v: %s", out, err, stderr)
+	}
+	for _, args := range []string{
+		"-merge -format json part0",
+		"-merge -format csv part0",
+		"-merge -count part0",
+		"-merge -line-numbers part0",
+		"-merge -showkeys part0",
+		"-merge -mark-left [ part0",
+		"-merge -desc part0",
+		"-merge -keyword a part0",
+		"-merge -fold part0",
+		"-merge -n 1 part0",
+	} {
+		out, stderr, err := runKwic(t, dir, "", args)
+		if err == nil {
+			t.Errorf("%s succeeded, writing %q", args, out)
+		} else if !strings.Contains(stderr, "Merging partial indexes") {
+			t.Errorf("%s failed with %q", args, stderr)
+		}
+	}
+}